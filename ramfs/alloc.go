@@ -0,0 +1,192 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// The FS usage includes all the memory allocated by the FS for nodes, names,
+// directory lists and file data. All sizes are rounded up to the sizes of the
+// memory blocks actually allocated by the Go runtime so the reported usage
+// bounds the real heap consumption.
+
+const (
+	nodeSize = int(unsafe.Sizeof(node{}))
+	extSize  = int(unsafe.Sizeof(nodeExt{}))
+	ptrSize  = int(unsafe.Sizeof((*node)(nil)))
+	sliSize  = int(unsafe.Sizeof([]byte(nil)))
+
+	maxSmallSize = 32768
+	pageSize     = 8192
+)
+
+// sizeClasses contains the sizes of the small memory blocks allocated by the
+// Go runtime.
+var sizeClasses = [...]uint16{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224,
+	240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768,
+	896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200,
+	3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728, 10240,
+	10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760, 24576,
+	27264, 28672, 32768,
+}
+
+// roundAlloc returns the size of the memory block allocated by the Go runtime
+// for an object of n bytes.
+func roundAlloc(n int) int {
+	switch {
+	case n <= 0:
+		return 0
+	case n <= maxSmallSize:
+		i, _ := slices.BinarySearch(sizeClasses[:], uint16(n))
+		return int(sizeClasses[i])
+	}
+	return (n + pageSize - 1) &^ (pageSize - 1)
+}
+
+// growCap returns the new capacity of a slice of elemSize elements that must be
+// able to store need elements. It uses the whole allocated memory block.
+func growCap(oldCap, need, elemSize int) int {
+	newCap := 2 * oldCap
+	if newCap < need {
+		newCap = need
+	}
+	return roundAlloc(newCap*elemSize) / elemSize
+}
+
+// nodeUsage returns the memory used by an empty node named name.
+func nodeUsage(name string) int64 {
+	return int64(roundAlloc(nodeSize) + roundAlloc(len(name)))
+}
+
+// contentUsage returns the memory used by the directory list and the file data
+// of n. The n.mu must be locked.
+func contentUsage(n *node) int64 {
+	return int64(roundAlloc(cap(n.list)*ptrSize) +
+		roundAlloc(cap(n.data)*sliSize) + n.alloc)
+}
+
+// extUsage returns the memory used by the optional metadata of n. The n.mu
+// must be locked.
+func extUsage(n *node) int64 {
+	if n.ext == nil {
+		return 0
+	}
+	return int64(roundAlloc(extSize))
+}
+
+// newNodeUsage returns the memory used by a new empty node named name,
+// including its optional metadata (see newExt).
+func (fsys *FS) newNodeUsage(name string) int64 {
+	usage := nodeUsage(name)
+	if fsys.extNodes {
+		usage += int64(roundAlloc(extSize))
+	}
+	return usage
+}
+
+// newExt returns the optional metadata for a new node if every node of the FS
+// must have it, otherwise nil. The new node is dirty (see Persistent).
+func (fsys *FS) newExt() *nodeExt {
+	if !fsys.extNodes {
+		return nil
+	}
+	return &nodeExt{dirty: true}
+}
+
+// allocExt allocates the optional metadata of n if it doesn't have it yet. If
+// force is false it fails if there is no space for it in the FS. The memory of
+// a removed node isn't accounted. The n.mu must be locked.
+func allocExt(fsys *FS, n *node, force bool) bool {
+	if n.ext != nil {
+		return true
+	}
+	if !n.removed {
+		add := int64(roundAlloc(extSize))
+		if force {
+			atomic.AddInt64(&fsys.size, add)
+		} else if !reserve(fsys, add) {
+			return false
+		}
+	}
+	n.ext = new(nodeExt)
+	return true
+}
+
+// reserve adds n bytes to the FS usage. It fails and leaves the usage
+// unchanged if the usage would exceed the FS maximum size.
+func reserve(fsys *FS, n int64) bool {
+	if !tryReserve(fsys, n) {
+		fsys.stats.noSpace.Add(1)
+		return false
+	}
+	return true
+}
+
+func tryReserve(fsys *FS, n int64) bool {
+	if atomic.AddInt64(&fsys.size, n) > fsys.maxSize && n > 0 {
+		atomic.AddInt64(&fsys.size, -n)
+		return false
+	}
+	return true
+}
+
+// reserveEvict works like reserve but if the FS was created with the EvictLRU
+// option it evicts files to make room for n bytes. fsys.mu must be locked and
+// no node can be locked by the caller.
+func reserveEvict(fsys *FS, n int64) bool {
+	for !tryReserve(fsys, n) {
+		if !fsys.evict || !fsys.evictLRU() {
+			fsys.stats.noSpace.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// evict removes the least recently opened file to make room for the file data
+// that didn't fit in the FS (see grow). It reports whether the caller should
+// retry. The caller can't hold any node lock because evictLRU locks the
+// directories and the evicted node.
+func evict(fsys *FS) bool {
+	if !fsys.evict {
+		return false
+	}
+	fsys.mu.Lock()
+	evicted := fsys.evictLRU()
+	fsys.mu.Unlock()
+	if !evicted {
+		fsys.stats.noSpace.Add(1)
+	}
+	return evicted
+}
+
+// makeRoom ensures that one more entry can be inserted into dir without memory
+// allocation. It can evict files (see reserveEvict) if evict is true, in which
+// case fsys.mu must be locked.
+func makeRoom(fsys *FS, dir *node, evict bool) error {
+	dir.mu.RLock()
+	full := len(dir.list) == cap(dir.list)
+	oldCap := cap(dir.list)
+	dir.mu.RUnlock()
+	if !full {
+		return nil
+	}
+	newCap := growCap(oldCap, oldCap+1, ptrSize)
+	add := int64(roundAlloc(newCap*ptrSize) - roundAlloc(oldCap*ptrSize))
+	if evict && !reserveEvict(fsys, add) || !evict && !reserve(fsys, add) {
+		return syscall.ENOSPC
+	}
+	dir.mu.Lock()
+	list := make([]*node, len(dir.list), newCap)
+	copy(list, dir.list)
+	dir.list = list
+	dir.mu.Unlock()
+	return nil
+}
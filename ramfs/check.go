@@ -0,0 +1,156 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync/atomic"
+)
+
+// Checksums returns an option that makes the FS maintain the CRC-32 checksum
+// of the content of every file. The checksums are verified by Check. Appending
+// to a file updates its checksum incrementally but any other write requires
+// to recalculate the checksum of the whole file.
+func Checksums() Option {
+	return func(fsys *FS) {
+		fsys.crc = true
+	}
+}
+
+// checksum calculates the CRC-32 checksum of the file data. It returns the
+// scratch buffer used to decompress the compressed chunks for reuse.
+func checksum(n *node, scratch []byte) (uint32, []byte) {
+	var crc uint32
+	scratch, _ = walkData(n, scratch, func(p []byte) {
+		crc = crc32.Update(crc, crc32.IEEETable, p)
+	})
+	return crc, scratch
+}
+
+// A checker collects the problems found by Check.
+type checker struct {
+	fsys    *FS
+	visited map[*node]bool
+	items   int
+	used    int64
+	scratch []byte
+	errs    []error
+}
+
+func (c *checker) errorf(path, format string, a ...any) {
+	c.errs = append(c.errs, fmt.Errorf("ramfs: %s: "+format, append([]any{path}, a...)...))
+}
+
+// Check verifies the integrity of the FS. It checks that the entries of every
+// directory are sorted and have unique names, that every node is referenced
+// only once, that the file data is consistent with the growth policy and the
+// file size and that the FS usage matches the memory actually used. If the FS
+// was created with the Checksums option the content of every file is verified
+// against its checksum. Check returns nil if no problems were found or an error
+// that describes all of them.
+//
+// Check is intended to be used after reset with the retained RAM content and
+// should be called before the FS is used. The tree modifications are blocked
+// during the check but concurrent writes can be reported as usage mismatch.
+func (fsys *FS) Check() (err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	c := &checker{fsys: fsys, visited: make(map[*node]bool)}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("ramfs: corrupted: %v", r)
+		}
+	}()
+	c.dir(&fsys.root, ".")
+	// the root node is part of the FS structure
+	c.used -= nodeUsage(".") + extUsage(&fsys.root)
+	if items := int(atomic.LoadInt32(&fsys.items)); items != c.items {
+		c.errorf(".", "%d items accounted but %d found", items, c.items)
+	}
+	if size := atomic.LoadInt64(&fsys.size); size != c.used {
+		c.errorf(".", "%d bytes accounted but %d used", size, c.used)
+	}
+	return errors.Join(c.errs...)
+}
+
+func (c *checker) dir(d *node, path string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	c.used += nodeUsage(d.name) + extUsage(d) + contentUsage(d)
+	if d.data != nil || d.size != 0 {
+		c.errorf(path, "directory contains data")
+	}
+	cmp := strings.Compare
+	if c.fsys.foldCase {
+		cmp = compareFold
+	}
+	for i, n := range d.list {
+		if n == nil {
+			c.errorf(path, "nil entry at index %d", i)
+			continue
+		}
+		name := n.name
+		if path != "." {
+			name = path + "/" + name
+		}
+		if c.visited[n] {
+			c.errorf(name, "node referenced more than once")
+			continue
+		}
+		c.visited[n] = true
+		c.items++
+		if n.name == "" || n.name == "." || n.name == ".." ||
+			strings.IndexByte(n.name, '/') >= 0 {
+			c.errorf(name, "invalid name")
+		}
+		if i > 0 && d.list[i-1] != nil && cmp(d.list[i-1].name, n.name) >= 0 {
+			c.errorf(name, "entry out of order or duplicated")
+		}
+		switch n.fileFS {
+		case nil:
+			c.dir(n, name)
+		case c.fsys:
+			c.file(n, name)
+		default:
+			c.errorf(name, "file belongs to another FS")
+		}
+	}
+}
+
+func (c *checker) file(n *node, path string) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	fsys := c.fsys
+	c.used += nodeUsage(n.name) + extUsage(n) + contentUsage(n)
+	if n.list != nil {
+		c.errorf(path, "file contains directory entries")
+	}
+	if n.size < 0 || n.size > fsys.capacity(len(n.data)) {
+		c.errorf(path, "size %d out of range", n.size)
+		return
+	}
+	alloc := 0
+	for i, buf := range n.data {
+		size := fsys.chunkLen(i)
+		if len(buf) > size || len(buf) < size && fsys.compressor == nil {
+			c.errorf(path, "chunk %d has invalid length %d", i, len(buf))
+			return
+		}
+		alloc += roundAlloc(len(buf))
+	}
+	if alloc != n.alloc {
+		c.errorf(path, "%d bytes of chunks accounted but %d used", n.alloc, alloc)
+	}
+	if fsys.crc {
+		var crc uint32
+		crc, c.scratch = checksum(n, c.scratch)
+		if crc != n.ext.crc {
+			c.errorf(path, "checksum mismatch")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"sync/atomic"
+)
+
+// Compact reclaims the memory allocated in advance: the unused capacity of the
+// directory lists and the file chunk lists and the chunks past the end of
+// files (see Create). If the FS was created with the Compression option the
+// uncompressed chunks are compressed. The files that are open are skipped,
+// only their chunk lists are trimmed. Compact returns the number of bytes
+// reclaimed. The tree modifications are blocked during Compact.
+func (fsys *FS) Compact() int64 {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	var scratch []byte
+	return fsys.compact(&fsys.root, &scratch)
+}
+
+func (fsys *FS) compact(n *node, scratch *[]byte) int64 {
+	n.mu.Lock()
+	used := contentUsage(n)
+	var packed int64 // pack updates the FS usage itself
+	if n.fileFS == nil {
+		if cap(n.list) != len(n.list) {
+			var list []*node
+			if len(n.list) != 0 {
+				list = make([]*node, len(n.list))
+				copy(list, n.list)
+			}
+			n.list = list
+		}
+	} else {
+		if atomic.LoadInt32(&n.opened) == 0 {
+			if fsys.compressor != nil {
+				for i := range n.data {
+					*scratch = pack(n, i, *scratch)
+				}
+				packed = used - contentUsage(n)
+			}
+			k := 0
+			for fsys.capacity(k) < n.size {
+				k++
+			}
+			for i := k; i < len(n.data); i++ {
+				buf := n.data[i]
+				if fsys.pool != nil && len(buf) == fsys.chunkLen(i) && !isShared(n, i) {
+					fsys.pool.Put(buf)
+				}
+				n.alloc -= roundAlloc(len(buf))
+				n.data[i] = nil
+			}
+			n.data = n.data[:k]
+		}
+		if cap(n.data) != len(n.data) {
+			var data [][]byte
+			if len(n.data) != 0 {
+				data = make([][]byte, len(n.data))
+				copy(data, n.data)
+			}
+			n.data = data
+		}
+	}
+	trimmed := used - packed - contentUsage(n)
+	atomic.AddInt64(&fsys.size, -trimmed)
+	freed := packed + trimmed
+	list := n.list
+	n.mu.Unlock()
+	for _, n := range list {
+		freed += fsys.compact(n, scratch)
+	}
+	return freed
+}
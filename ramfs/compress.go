@@ -0,0 +1,92 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// If the FS is created with the Compression option the file chunks that are
+// no longer written are compressed. A chunk is considered compressed if its
+// length differs from the chunk size determined by the growth policy. A chunk
+// is kept uncompressed if compression doesn't reduce its memory usage.
+// Compressed chunks are decompressed into a scratch buffer of the open file on
+// read and replaced by the uncompressed ones on write.
+
+// A Compressor compresses and decompresses file data chunks.
+type Compressor interface {
+	// Compress appends the compressed src to dst and returns the result.
+	Compress(dst, src []byte) []byte
+
+	// Decompress appends the decompressed src to dst and returns the result.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Compression returns an option that makes the FS store file data compressed
+// using c. The chunks of a file are compressed after they are completely
+// written and when the file open for writing is closed. Larger chunks usually
+// give better compression ratio but reading and modifying a compressed file is
+// slower because the whole chunk has to be decompressed.
+func Compression(c Compressor) Option {
+	return func(fsys *FS) {
+		fsys.compressor = c
+	}
+}
+
+// pack compresses the i-th chunk of n if it isn't compressed yet and the
+// compression reduces its memory usage. The scratch buffer is used for the
+// compressor output. The returned slice should be used as scratch buffer in
+// the subsequent pack calls.
+func pack(n *node, i int, scratch []byte) []byte {
+	fsys := n.fileFS
+	raw := n.data[i]
+	size := len(raw)
+	if size != fsys.chunkLen(i) {
+		return scratch // already compressed
+	}
+	z := fsys.compressor.Compress(scratch[:0], raw)
+	if zsize := roundAlloc(len(z)); zsize < size {
+		buf := make([]byte, len(z))
+		copy(buf, z)
+		n.data[i] = buf
+		n.alloc -= size - zsize
+		atomic.AddInt64(&fsys.size, int64(zsize-size))
+		if fsys.pool != nil && !isShared(n, i) {
+			fsys.pool.Put(raw)
+		}
+		unshare(n, i)
+	}
+	return z
+}
+
+// unpack appends the decompressed chunk z to dst. The decompressed chunk must
+// have the given size.
+func unpack(fsys *FS, dst, z []byte, size int) ([]byte, error) {
+	dst, err := fsys.compressor.Decompress(dst, z)
+	if err == nil && len(dst) != size {
+		err = syscall.EIO
+	}
+	return dst, err
+}
+
+// inflate replaces the compressed i-th chunk of n with the decompressed one.
+func inflate(n *node, i int) error {
+	fsys := n.fileFS
+	size := fsys.chunkLen(i)
+	z := n.data[i]
+	add := int64(size - roundAlloc(len(z)))
+	if !reserve(fsys, add) {
+		return syscall.ENOSPC
+	}
+	raw, err := unpack(fsys, newChunk(fsys, size)[:0], z, size)
+	if err != nil {
+		atomic.AddInt64(&fsys.size, -add)
+		return err
+	}
+	n.data[i] = raw
+	n.alloc += int(add)
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"io/fs"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CopyFile copies the content of the src file to the dst file. The dst file is
+// created or truncated.
+func (fsys *FS) CopyFile(dst, src string) error {
+	return fsys.copyFile("copy", dst, src, false)
+}
+
+// Clone works like CopyFile but the copy shares the data chunks with the
+// original file until any of them is modified (copy-on-write). Clone doesn't
+// copy any data but the memory is accounted as for the full copy so modifying
+// any of the files never fails for lack of space.
+func (fsys *FS) Clone(dst, src string) error {
+	return fsys.copyFile("clone", dst, src, true)
+}
+
+func (fsys *FS) copyFile(op, dst, src string, share bool) error {
+	var err error
+	name := src
+	{
+		if !fs.ValidPath(src) || !fs.ValidPath(dst) {
+			err = syscall.EINVAL
+			goto error
+		}
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+		s := &fsys.root
+		if src != "." {
+			if s = fsys.find(&fsys.root, src); s == nil {
+				err = syscall.ENOENT
+				goto error
+			}
+		}
+		if s.fileFS == nil {
+			err = syscall.EISDIR
+			goto error
+		}
+		// prevent the eviction of s when creating dst (see EvictLRU)
+		atomic.AddInt32(&s.opened, 1)
+		defer atomic.AddInt32(&s.opened, -1)
+		name = dst
+		if fsys.find(&fsys.root, dst) == s {
+			err = syscall.EINVAL
+			goto error
+		}
+		var d *node
+		if d, _, err = fsys.openNode(dst, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC); err != nil {
+			err.(*fs.PathError).Op = op
+			return err
+		}
+		if d.fileFS == nil {
+			err = syscall.EISDIR
+			goto error
+		}
+
+		s.mu.Lock()
+		data := slices.Clone(s.data)
+		alloc, size := s.alloc, s.size
+		var crc uint32
+		if s.ext != nil {
+			crc = s.ext.crc
+		}
+		if !reserve(fsys, int64(roundAlloc(cap(data)*sliSize)+alloc)) {
+			s.mu.Unlock()
+			err = syscall.ENOSPC
+			goto error
+		}
+		if share {
+			shareAll(s)
+		} else {
+			for i, buf := range data {
+				if len(buf) == fsys.chunkLen(i) {
+					data[i] = newChunk(fsys, len(buf))
+					copy(data[i], buf)
+				}
+				// the compressed chunks are never modified in place
+			}
+		}
+		s.mu.Unlock()
+
+		d.mu.Lock()
+		if d.data != nil {
+			// written after truncation by another open file
+			atomic.AddInt64(&fsys.size, -contentUsage(d))
+			free(d)
+		}
+		d.data = data
+		d.alloc, d.size = alloc, size
+		if share {
+			shareAll(d)
+		}
+		if d.ext != nil {
+			d.ext.crc = crc
+		}
+		d.gen++
+		markDirty(d)
+		mtime := time.Now()
+		d.modSec = mtime.Unix()
+		d.modNsec = mtime.Nanosecond()
+		d.mu.Unlock()
+		return nil
+	}
+error:
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
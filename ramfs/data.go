@@ -0,0 +1,302 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"sync"
+	"syscall"
+)
+
+// File data is stored in a list of chunks. Growing a file allocates only the
+// missing chunks and never copies the data already written so the peak memory
+// usage is at most one chunk above the file size and the heap isn't fragmented
+// by the large short-lived buffers.
+//
+// The chunk sizes are determined by the FS growth policy. The first chunk has
+// chunkMin bytes and every next one is twice as large as the previous one up to
+// chunkMax bytes. All chunks above this limit have the same size.
+
+const defaultChunkSize = 64
+
+// chunkLen returns the size of the i-th chunk of a file rounded up to the size
+// of the memory block allocated for it.
+func (fsys *FS) chunkLen(i int) int {
+	n := fsys.chunkMax
+	if i < 31 {
+		if m := fsys.chunkMin << uint(i); 0 < m && m < n {
+			n = m
+		}
+	}
+	return roundAlloc(n)
+}
+
+// grow ensures the file represented by n can store size bytes. The memory of a
+// removed file isn't accounted in the FS usage anymore so it can grow without
+// any limit until it's closed. grow doesn't evict files because n is locked.
+// If it returns ENOSPC the caller should unlock n and try again if evict
+// reports true.
+func grow(n *node, size int) error {
+	fsys := n.fileFS
+	capacity := fsys.capacity(len(n.data))
+	if capacity >= size {
+		return nil
+	}
+	add, m := 0, len(n.data)
+	for capacity+add < size {
+		add += fsys.chunkLen(m)
+		m++
+	}
+	newCap := cap(n.data)
+	if m > newCap {
+		newCap = growCap(newCap, m, sliSize)
+	}
+	listAdd := roundAlloc(newCap*sliSize) - roundAlloc(cap(n.data)*sliSize)
+	if !n.removed && !tryReserve(fsys, int64(add+listAdd)) {
+		if !fsys.evict {
+			fsys.stats.noSpace.Add(1) // otherwise counted by evict
+		}
+		return syscall.ENOSPC
+	}
+	if newCap != cap(n.data) {
+		data := make([][]byte, len(n.data), newCap)
+		copy(data, n.data)
+		n.data = data
+	}
+	for i := len(n.data); i < m; i++ {
+		n.data = append(n.data, newChunk(fsys, fsys.chunkLen(i)))
+	}
+	n.alloc += add
+	return nil
+}
+
+// newChunk returns a zeroed chunk of a given size, taken from the FS pool if
+// possible.
+func newChunk(fsys *FS, size int) (buf []byte) {
+	if fsys.pool != nil {
+		buf = fsys.pool.Get(size)
+	}
+	if buf == nil {
+		return make([]byte, size)
+	}
+	clear(buf)
+	return buf
+}
+
+// capacity returns the total size of the first k chunks of a file.
+func (fsys *FS) capacity(k int) (c int) {
+	max := roundAlloc(fsys.chunkMax)
+	i := 0
+	for ; i < k; i++ {
+		n := fsys.chunkLen(i)
+		if n == max {
+			break
+		}
+		c += n
+	}
+	return c + (k-i)*max
+}
+
+// seek returns the index of the chunk that contains the byte at offset off and
+// the offset of this byte in the chunk.
+func (fsys *FS) seek(off int) (i, o int) {
+	max := roundAlloc(fsys.chunkMax)
+	for {
+		n := fsys.chunkLen(i)
+		if n == max {
+			// all the following chunks have the same size
+			return i + off/n, off % n
+		}
+		if off < n {
+			return i, off
+		}
+		off -= n
+		i++
+	}
+}
+
+// readAt copies the data at offset off from the file chunks to p. The data
+// must be in the file chunks.
+func (f *file) readAt(p []byte, off int) (n int, err error) {
+	for n < len(p) {
+		var buf []byte
+		if buf, err = f.view(off + n); err != nil {
+			break
+		}
+		n += copy(p[n:], buf)
+	}
+	return n, err
+}
+
+// view returns the data at offset off up to the end of the chunk that contains
+// it. The compressed chunk is decompressed into the f.zbuf scratch buffer.
+func (f *file) view(off int) ([]byte, error) {
+	fsys := f.n.fileFS
+	i, o := fsys.seek(off)
+	buf := f.n.data[i]
+	if size := fsys.chunkLen(i); len(buf) != size {
+		// compressed chunk
+		if f.zidx != i || f.zgen != f.n.gen {
+			f.zidx = -1
+			var err error
+			if f.zbuf, err = unpack(fsys, f.zbuf[:0], buf, size); err != nil {
+				return nil, err
+			}
+			f.zidx, f.zgen = i, f.n.gen
+		}
+		buf = f.zbuf
+	}
+	return buf[o:], nil
+}
+
+// writeAt copies p to the chunks of the file represented by n at offset off.
+// The chunks must have enough space to store the whole p. Compressed and shared
+// chunks are replaced by the private uncompressed ones before writing.
+func writeAt(n *node, p []byte, off int) (m int, err error) {
+	fsys := n.fileFS
+	n.gen++
+	i, o := fsys.seek(off)
+	for ; m < len(p); i++ {
+		if err = writable(n, i); err != nil {
+			return m, err
+		}
+		m += copy(n.data[i][o:], p[m:])
+		o = 0
+	}
+	return m, nil
+}
+
+// isShared reports whether the i-th chunk of n can be shared with other files.
+func isShared(n *node, i int) bool {
+	if n.ext == nil {
+		return false
+	}
+	w := i / 64
+	return w < len(n.ext.shared) && n.ext.shared[w]&(1<<uint(i%64)) != 0
+}
+
+// unshare marks the i-th chunk of n as not shared.
+func unshare(n *node, i int) {
+	if w := i / 64; n.ext != nil && w < len(n.ext.shared) {
+		n.ext.shared[w] &^= 1 << uint(i%64)
+	}
+}
+
+// shareAll marks all chunks of n as shared. The memory for the node metadata
+// is accounted even if it exceeds the FS maximum size (see Clone).
+func shareAll(n *node) {
+	allocExt(n.fileFS, n, true)
+	shared := make([]uint64, (len(n.data)+63)/64)
+	for i := range shared {
+		shared[i] = ^uint64(0)
+	}
+	n.ext.shared = shared
+}
+
+// writable ensures that the i-th chunk of n can be modified in place. The
+// compressed chunk is decompressed and the shared one is copied. The memory
+// for the copy of the shared chunk is already accounted (see Clone).
+func writable(n *node, i int) error {
+	fsys := n.fileFS
+	if len(n.data[i]) != fsys.chunkLen(i) {
+		if err := inflate(n, i); err != nil {
+			return err
+		}
+	} else if isShared(n, i) {
+		buf := newChunk(fsys, len(n.data[i]))
+		copy(buf, n.data[i])
+		n.data[i] = buf
+	}
+	unshare(n, i)
+	return nil
+}
+
+// walkData calls fn for the consecutive parts of the file data represented by
+// n. Compressed chunks are decompressed into the scratch buffer. walkData
+// returns the scratch buffer for reuse.
+func walkData(n *node, scratch []byte, fn func(p []byte)) ([]byte, error) {
+	fsys := n.fileFS
+	remain := n.size
+	for i := 0; remain > 0 && i < len(n.data); i++ {
+		buf := n.data[i]
+		if size := fsys.chunkLen(i); len(buf) != size {
+			var err error
+			if scratch, err = unpack(fsys, scratch[:0], buf, size); err != nil {
+				return scratch, err
+			}
+			buf = scratch
+		}
+		buf = buf[:min(len(buf), remain)]
+		fn(buf)
+		remain -= len(buf)
+	}
+	return scratch, nil
+}
+
+// free releases the data chunks of the file represented by n. It doesn't
+// update the FS usage.
+func free(n *node) {
+	fsys := n.fileFS
+	if fsys.pool != nil {
+		for i, buf := range n.data {
+			if len(buf) == fsys.chunkLen(i) && !isShared(n, i) {
+				fsys.pool.Put(buf)
+			}
+		}
+	}
+	n.data = nil
+	n.alloc = 0
+	n.size = 0
+	if n.ext != nil {
+		n.ext.shared = nil
+		n.ext.crc = 0
+	}
+	n.gen++
+}
+
+// A Pool can be used to reuse the memory of the data chunks released by the
+// removed or truncated files.
+type Pool interface {
+	// Get returns a buffer of the given size or nil if there is no such
+	// buffer in the pool. The content of the returned buffer is undefined.
+	Get(size int) []byte
+
+	// Put adds buf to the pool. It may discard buf if the pool is full.
+	Put(buf []byte)
+}
+
+// A freeList is a simple Pool implementation that keeps up to max bytes of
+// free buffers.
+type freeList struct {
+	mu   sync.Mutex
+	bufs [][]byte
+	size int
+	max  int
+}
+
+func (fl *freeList) Get(size int) (buf []byte) {
+	fl.mu.Lock()
+	for i := len(fl.bufs) - 1; i >= 0; i-- {
+		if len(fl.bufs[i]) == size {
+			buf = fl.bufs[i]
+			last := len(fl.bufs) - 1
+			fl.bufs[i] = fl.bufs[last]
+			fl.bufs[last] = nil
+			fl.bufs = fl.bufs[:last]
+			fl.size -= size
+			break
+		}
+	}
+	fl.mu.Unlock()
+	return
+}
+
+func (fl *freeList) Put(buf []byte) {
+	fl.mu.Lock()
+	if fl.size+len(buf) <= fl.max {
+		fl.bufs = append(fl.bufs, buf)
+		fl.size += len(buf)
+	}
+	fl.mu.Unlock()
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"hash/maphash"
+	"slices"
+	"sync/atomic"
+)
+
+// Dedup returns an option that makes the FS look for a file with the same
+// content when a file open for writing is closed. If found, both files share
+// the data chunks copy-on-write (see Clone). The files are matched by the hash
+// of their content and compared byte by byte. The shared chunks are accounted
+// for every file so deduplication saves memory but doesn't reduce the FS usage
+// and modifying a deduplicated file never fails with ENOSPC.
+func Dedup() Option {
+	return func(fsys *FS) {
+		fsys.dedup = true
+		fsys.seed = maphash.MakeSeed()
+	}
+}
+
+// dedup makes n share its data chunks with another file of the same content,
+// if there is such a file. The scratch buffer is used to decompress the
+// compressed chunks. dedup returns the scratch buffer for reuse.
+func dedup(n *node, scratch []byte) []byte {
+	fsys := n.fileFS
+	n.mu.Lock()
+	if n.removed || n.size == 0 || n.ext.hashGen == n.gen && n.ext.hash != 0 {
+		n.mu.Unlock()
+		return scratch
+	}
+	var h maphash.Hash
+	h.SetSeed(fsys.seed)
+	scratch, err := walkData(n, scratch, func(p []byte) { h.Write(p) })
+	if err != nil {
+		n.mu.Unlock()
+		return scratch
+	}
+	hash := h.Sum64() | 1 // 0 means no hash
+	n.ext.hash, n.ext.hashGen = hash, n.gen
+	gen, size := n.gen, n.size
+	n.mu.Unlock()
+
+	// Only one goroutine can lock two file nodes at the same time.
+	fsys.dmu.Lock()
+	defer fsys.dmu.Unlock()
+	c := fsys.findDup(&fsys.root, n, hash, size)
+	if c == nil {
+		return scratch
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed || c.ext.hashGen != c.gen || c.ext.hash != hash || c.size != size {
+		return scratch
+	}
+	// Compare the content with both nodes locked and share the chunks of c
+	// only if it's the same.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	used := contentUsage(n)
+	newUsed := int64(roundAlloc(cap(c.data)*sliSize) + c.alloc)
+	if n.removed || n.gen != gen || newUsed > used {
+		return scratch
+	}
+	var same bool
+	if same, scratch, err = sameData(fsys, n.data, c.data, size, scratch); !same || err != nil {
+		return scratch
+	}
+	shareAll(c)
+	data := slices.Clone(c.data)
+	alloc := c.alloc
+	crc := n.ext.crc
+	free(n)
+	n.data = data
+	n.alloc = alloc
+	n.size = size
+	n.ext.crc = crc
+	shareAll(n)
+	n.ext.hash, n.ext.hashGen = hash, n.gen
+	atomic.AddInt64(&fsys.size, newUsed-used)
+	return scratch
+}
+
+// findDup searches the tree starting from dir for a file other than n with
+// the given content hash and size.
+func (fsys *FS) findDup(dir, n *node, hash uint64, size int) *node {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	for _, c := range dir.list {
+		if c.fileFS == nil {
+			if c = fsys.findDup(c, n, hash, size); c != nil {
+				return c
+			}
+			continue
+		}
+		if c == n {
+			continue
+		}
+		c.mu.RLock()
+		found := c.ext.hash == hash && c.ext.hashGen == c.gen && c.size == size
+		c.mu.RUnlock()
+		if found {
+			return c
+		}
+	}
+	return nil
+}
+
+// sameData reports whether the first size bytes stored in the chunks x and y
+// are the same. Both chunk lists must follow the FS growth policy.
+func sameData(fsys *FS, x, y [][]byte, size int, scratch []byte) (bool, []byte, error) {
+	var scratch2 []byte
+	for i := 0; size > 0; i++ {
+		var err error
+		bx, by := x[i], y[i]
+		if n := fsys.chunkLen(i); len(bx) != n {
+			if scratch, err = unpack(fsys, scratch[:0], bx, n); err != nil {
+				return false, scratch, err
+			}
+			bx = scratch
+		}
+		if n := fsys.chunkLen(i); len(by) != n {
+			if scratch2, err = unpack(fsys, scratch2[:0], by, n); err != nil {
+				return false, scratch, err
+			}
+			by = scratch2
+		}
+		n := min(len(bx), size)
+		if !bytes.Equal(bx[:n], by[:n]) {
+			return false, scratch, nil
+		}
+		size -= n
+	}
+	return true, scratch, nil
+}
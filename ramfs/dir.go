@@ -8,11 +8,13 @@ import (
 	"io"
 	"io/fs"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
 // A dir represents an open directory
 type dir struct {
+	fsys *FS
 	name string
 
 	mu     sync.Mutex // protects the fields below
@@ -27,34 +29,37 @@ func (d *dir) Read(p []byte) (int, error) {
 
 func (d *dir) Stat() (fs.FileInfo, error) {
 	d.mu.Lock()
-	fi := stat(d.n)
+	n := d.n
 	d.mu.Unlock()
-	return fi, nil
+	if n == nil {
+		return nil, &fs.PathError{Op: "stat", Path: d.name, Err: syscall.EBADF}
+	}
+	return stat(n), nil
 }
 
+// ReadDir implements the fs.ReadDirFile ReadDir method.
 func (d *dir) ReadDir(n int) (de []fs.DirEntry, err error) {
 	d.mu.Lock()
+	if d.n == nil {
+		d.mu.Unlock()
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: syscall.EBADF}
+	}
 	d.n.mu.RLock()
-	var first *node
-	m := 0
-	for e := d.n.list; e != nil; e = e.next {
-		if m == d.pos {
-			first = e
+	list := d.n.list[min(d.pos, len(d.n.list)):]
+	if len(list) == 0 {
+		if n > 0 {
+			err = io.EOF
 		}
-		m++
-	}
-	m -= d.pos
-	if m == 0 {
-		err = io.EOF
 	} else {
-		if n > 0 && m > n {
-			m = n
+		if n > 0 && len(list) > n {
+			list = list[:n]
 		}
-		d.pos += m
-		de = make([]fs.DirEntry, m)
-		for i := range de {
-			de[i] = stat(first)
-			first = first.next
+		d.pos += len(list)
+		de = make([]fs.DirEntry, len(list))
+		ents := make([]dirEntry, len(list))
+		for i, n := range list {
+			ents[i] = dirEntry{n: n, name: n.name}
+			de[i] = &ents[i]
 		}
 	}
 	d.n.mu.RUnlock()
@@ -68,6 +73,8 @@ func (d *dir) Close() error {
 	if d.n == nil {
 		err = &fs.PathError{Op: "close", Path: d.name, Err: syscall.EBADF}
 	} else {
+		atomic.AddInt32(&d.n.opened, -1)
+		atomic.AddInt32(&d.fsys.opened, -1)
 		d.n = nil
 		if d.closed != nil {
 			d.closed()
@@ -77,3 +84,37 @@ func (d *dir) Close() error {
 	d.mu.Unlock()
 	return err
 }
+
+// A dirEntry implements fs.DirEntry. The file information is obtained from
+// the node on the Info call so listing a directory doesn't require to lock its
+// entries.
+type dirEntry struct {
+	n    *node
+	name string
+}
+
+func (de *dirEntry) Name() string { return de.name }
+func (de *dirEntry) IsDir() bool  { return de.n.fileFS == nil }
+
+func (de *dirEntry) Type() fs.FileMode {
+	if de.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// Info returns the current information about the node. It fails with ENOENT if
+// the node was removed after ReadDir.
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	de.n.mu.RLock()
+	removed := de.n.removed
+	de.n.mu.RUnlock()
+	if removed {
+		return nil, &fs.PathError{Op: "stat", Path: de.name, Err: syscall.ENOENT}
+	}
+	fi := stat(de.n)
+	fi.name = de.name
+	return fi, nil
+}
+
+func (de *dirEntry) String() string { return fs.FormatDirEntry(de) }
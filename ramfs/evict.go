@@ -0,0 +1,53 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import "sync/atomic"
+
+// EvictLRU returns an option that makes the FS remove the least recently
+// opened files that aren't open when there is no space for a new file or new
+// data, instead of failing with ENOSPC. Directories are never evicted. This
+// turns the FS into a bounded cache, e.g. for the resources fetched from the
+// network.
+func EvictLRU() Option {
+	return func(fsys *FS) {
+		fsys.evict = true
+	}
+}
+
+// evictLRU removes the least recently opened file that isn't open. It reports
+// whether a file was removed. fsys.mu must be locked.
+func (fsys *FS) evictLRU() bool {
+	var e struct {
+		n, dir *node
+		name   string
+	}
+	var find func(dir *node, path string)
+	find = func(dir *node, path string) {
+		dir.mu.RLock()
+		defer dir.mu.RUnlock()
+		for _, n := range dir.list {
+			name := n.name
+			if path != "" {
+				name = path + "/" + name
+			}
+			if n.fileFS == nil {
+				find(n, name)
+			} else if atomic.LoadInt32(&n.opened) == 0 &&
+				(e.n == nil || n.ext.used.Load() < e.n.ext.used.Load()) {
+				e.n, e.dir, e.name = n, dir, name
+			}
+		}
+	}
+	find(&fsys.root, "")
+	if e.n == nil {
+		return false
+	}
+	fsys.unlink(e.dir, e.n.name)
+	release(fsys, e.n)
+	fsys.deleted(e.name)
+	fsys.stats.evictions.Add(1)
+	return true
+}
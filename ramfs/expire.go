@@ -0,0 +1,123 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"io/fs"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// SetExpiry sets the expiry time of the named file or directory. The expired
+// nodes are removed by Expire. Use time.Now().Add(ttl) to set a time-to-live
+// and the zero time to clear the expiry time.
+func (fsys *FS) SetExpiry(name string, t time.Time) error {
+	var err error
+	{
+		if !fs.ValidPath(name) {
+			err = syscall.EINVAL
+			goto error
+		}
+		if name == "." {
+			err = syscall.ENOTSUP
+			goto error
+		}
+		n := fsys.find(&fsys.root, name)
+		if n == nil {
+			err = syscall.ENOENT
+			goto error
+		}
+		var expires int64
+		if !t.IsZero() {
+			expires = t.UnixNano()
+		}
+		n.mu.Lock()
+		if n.removed {
+			err = syscall.ENOENT
+		} else if expires != 0 && !allocExt(fsys, n, false) {
+			err = syscall.ENOSPC
+		} else if n.ext != nil {
+			n.ext.expires = expires
+		}
+		n.mu.Unlock()
+		if err != nil {
+			goto error
+		}
+		return nil
+	}
+error:
+	return &fs.PathError{Op: "setexpiry", Path: name, Err: err}
+}
+
+// Expire removes all files and directories that have expired at the time now.
+// An expired directory is removed with all its content. If the FS was created
+// with the ProtectOpen option the expired nodes that are open (or contain open
+// nodes) are kept until the next Expire call. Expire returns the number of
+// removed files and directories.
+func (fsys *FS) Expire(now time.Time) int {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.expire(&fsys.root, "", now.UnixNano())
+}
+
+func (fsys *FS) expire(dir *node, path string, now int64) (removed int) {
+	dir.mu.RLock()
+	list := slices.Clone(dir.list)
+	dir.mu.RUnlock()
+	for _, n := range list {
+		name := n.name
+		if path != "" {
+			name = path + "/" + name
+		}
+		var expires int64
+		n.mu.RLock()
+		if n.ext != nil {
+			expires = n.ext.expires
+		}
+		n.mu.RUnlock()
+		if expires != 0 && expires <= now && !fsys.isBusyTree(n) {
+			fsys.unlink(dir, n.name)
+			removed += releaseTree(fsys, n)
+			fsys.deleted(name)
+		} else if n.fileFS == nil {
+			removed += fsys.expire(n, name, now)
+		}
+	}
+	return removed
+}
+
+// isBusyTree works like isBusy but also checks the content of directories.
+func (fsys *FS) isBusyTree(n *node) bool {
+	if fsys.isBusy(n) {
+		return true
+	}
+	if fsys.protectOpen && n.fileFS == nil {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		for _, n := range n.list {
+			if fsys.isBusyTree(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// releaseTree works like release but also releases the content of
+// directories. It returns the number of released nodes.
+func releaseTree(fsys *FS, n *node) int {
+	cnt := 1
+	if n.fileFS == nil {
+		n.mu.RLock()
+		list := n.list
+		n.mu.RUnlock()
+		for _, n := range list {
+			cnt += releaseTree(fsys, n)
+		}
+	}
+	release(fsys, n)
+	return cnt
+}
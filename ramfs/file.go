@@ -5,6 +5,7 @@
 package ramfs
 
 import (
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"sync"
@@ -15,13 +16,17 @@ import (
 
 // A file represents an open file
 type file struct {
-	name string
-	rdwr int
+	name   string
+	rdwr   int
+	append bool // write at the end of file (O_APPEND)
 
 	mu     sync.Mutex // protects the fields below
 	n      *node
 	pos    int
 	closed func()
+	zbuf   []byte // scratch buffer for (de)compression
+	zidx   int    // index of the decompressed chunk in zbuf or -1
+	zgen   uint32 // n.gen at the time of decompression
 }
 
 func (f *file) Read(p []byte) (n int, err error) {
@@ -36,9 +41,13 @@ func (f *file) Read(p []byte) (n int, err error) {
 		err = syscall.EISDIR
 	} else {
 		f.n.mu.RLock()
-		if f.pos < len(f.n.data) {
-			n = copy(p, f.n.data[f.pos:])
+		if f.pos < f.n.size {
+			if m := f.n.size - f.pos; len(p) > m {
+				p = p[:m]
+			}
+			n, err = f.readAt(p, f.pos)
 			f.pos += n
+			f.n.fileFS.stats.read(n)
 		} else {
 			err = io.EOF
 		}
@@ -63,41 +72,22 @@ func (f *file) Write(p []byte) (n int, err error) {
 	} else if f.n.fileFS == nil {
 		err = syscall.EISDIR
 	} else {
-		f.n.mu.Lock()
-		pos1 := f.pos + len(p)
-		if pos1 > cap(f.n.data) {
-			var roundUp int
-			switch {
-			case cap(f.n.data) < 64:
-				roundUp = 15
-			case cap(f.n.data) < 256:
-				roundUp = 31
-			default:
-				roundUp = 63
+		for {
+			f.n.mu.Lock()
+			if f.append {
+				f.pos = f.n.size
 			}
-			newCap := (pos1 + roundUp) &^ roundUp
-			add := newCap - cap(f.n.data)
-			if atomic.AddInt64(&f.n.fileFS.size, int64(add)) > f.n.fileFS.maxSize {
-				atomic.AddInt64(&f.n.fileFS.size, int64(-add))
-				err = syscall.ENOSPC
-				goto skip
+			if err = grow(f.n, f.pos+len(p)); err == nil {
+				pos := f.pos
+				n, err = writeAt(f.n, p, pos)
+				f.wrote(pos, p[:n])
+				f.n.fileFS.stats.write(n)
+			}
+			f.n.mu.Unlock()
+			if err != syscall.ENOSPC || !evict(f.n.fileFS) {
+				break
 			}
-			data1 := make([]byte, pos1, newCap)
-			copy(data1[:f.pos], f.n.data)
-			f.n.data = data1
-		} else if pos1 > len(f.n.data) {
-			f.n.data = f.n.data[:pos1]
-		}
-		copy(f.n.data[f.pos:], p)
-		f.pos = pos1
-		{
-			mtime := time.Now()
-			f.n.modSec = mtime.Unix()
-			f.n.modNsec = mtime.Nanosecond()
 		}
-		n = len(p)
-	skip:
-		f.n.mu.Unlock()
 	}
 	f.mu.Unlock()
 end:
@@ -107,11 +97,110 @@ end:
 	return n, err
 }
 
+// wrote updates the file position, the file size, the checksum and the
+// modification time after p was written to the file data at offset pos. It
+// compresses the chunks passed over by the write. The node must be locked.
+func (f *file) wrote(pos int, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	size := f.n.size
+	f.pos = pos + len(p)
+	if f.pos > f.n.size {
+		f.n.size = f.pos
+	}
+	if f.n.fileFS.crc {
+		if pos == size {
+			f.n.ext.crc = crc32.Update(f.n.ext.crc, crc32.IEEETable, p)
+		} else {
+			f.n.ext.crc, f.zbuf = checksum(f.n, f.zbuf)
+			f.zidx = -1
+		}
+	}
+	markDirty(f.n)
+	mtime := time.Now()
+	f.n.modSec = mtime.Unix()
+	f.n.modNsec = mtime.Nanosecond()
+	if fsys := f.n.fileFS; fsys.compressor != nil {
+		// compress the chunks passed over by this write
+		i, _ := fsys.seek(pos)
+		end, _ := fsys.seek(f.pos)
+		for ; i < end; i++ {
+			f.zbuf = pack(f.n, i, f.zbuf)
+			f.zidx = -1
+		}
+	}
+}
+
+// Peek returns up to n next bytes of the file without advancing the file
+// position. The returned slice refers directly to the file data so Peek
+// allows to parse the file content without copying it. It can be shorter than
+// n bytes (but not empty) if the requested data isn't stored contiguously.
+// Peek returns io.EOF at the end of file.
+//
+// The returned slice must not be modified and is valid only until the next
+// Read, Peek or Close call on f or until the file is modified by any open
+// file. Use Discard to advance the file position over the peeked data.
+func (f *file) Peek(n int) (p []byte, err error) {
+	if f.rdwr == syscall.O_WRONLY {
+		err = syscall.EBADF
+		goto end
+	}
+	f.mu.Lock()
+	if f.n == nil {
+		err = syscall.EBADF
+	} else {
+		f.n.mu.RLock()
+		if f.pos < f.n.size {
+			if p, err = f.view(f.pos); err == nil {
+				p = p[:min(len(p), n, f.n.size-f.pos)]
+			}
+		} else {
+			err = io.EOF
+		}
+		f.n.mu.RUnlock()
+	}
+	f.mu.Unlock()
+end:
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "peek", Path: f.name, Err: err}
+	}
+	return p, err
+}
+
+// Discard skips the next n bytes of the file, returning the number of bytes
+// discarded. If Discard skips fewer than n bytes it returns io.EOF.
+func (f *file) Discard(n int) (discarded int, err error) {
+	f.mu.Lock()
+	if f.n == nil {
+		err = &fs.PathError{Op: "discard", Path: f.name, Err: syscall.EBADF}
+	} else {
+		f.n.mu.RLock()
+		discarded = max(min(n, f.n.size-f.pos), 0)
+		f.n.mu.RUnlock()
+		f.pos += discarded
+		if discarded < n {
+			err = io.EOF
+		}
+	}
+	f.mu.Unlock()
+	return discarded, err
+}
+
+// ReadDir implements the fs.ReadDirFile ReadDir method. It always fails
+// because f isn't a directory.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
 func (f *file) Stat() (fs.FileInfo, error) {
 	f.mu.Lock()
-	fi := stat(f.n)
+	n := f.n
 	f.mu.Unlock()
-	return fi, nil
+	if n == nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: syscall.EBADF}
+	}
+	return stat(n), nil
 }
 
 func (f *file) Close() error {
@@ -120,7 +209,20 @@ func (f *file) Close() error {
 	if f.n == nil {
 		err = &fs.PathError{Op: "close", Path: f.name, Err: syscall.EBADF}
 	} else {
+		if f.rdwr != syscall.O_RDONLY && f.n.fileFS.compressor != nil {
+			f.n.mu.Lock()
+			for i := range f.n.data {
+				f.zbuf = pack(f.n, i, f.zbuf)
+			}
+			f.n.mu.Unlock()
+		}
+		if f.rdwr != syscall.O_RDONLY && f.n.fileFS.dedup {
+			f.zbuf = dedup(f.n, f.zbuf)
+		}
+		atomic.AddInt32(&f.n.opened, -1)
+		atomic.AddInt32(&f.n.fileFS.opened, -1)
 		f.n = nil
+		f.zbuf = nil
 		if f.closed != nil {
 			f.closed()
 			f.closed = nil
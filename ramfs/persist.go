@@ -0,0 +1,182 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"io"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// If the FS is created with the Persistent option it works as a write-back
+// cache of a Store. The content of the store is loaded by New. The modified
+// files and directories are marked dirty and written to the store by Sync.
+// The names of the removed (or renamed) nodes are recorded and deleted from
+// the store by Sync before the dirty nodes are written.
+
+// A Store is a persistent storage (flash, battery-backed RAM) for the FS
+// content.
+type Store interface {
+	// Load calls fn for all the stored files and directories. A directory
+	// must be reported before its content. The data of a file can be read
+	// from r until fn returns. For directories r is nil.
+	Load(fn func(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error) error
+
+	// Save stores the file or directory (mode.IsDir() reports true, r is nil)
+	// under the given name. An already stored file is replaced.
+	Save(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error
+
+	// Delete removes the named file or directory, including all its content,
+	// from the store. Deleting a non-existent name isn't an error.
+	Delete(name string) error
+}
+
+// Persistent returns an option that makes the FS load its initial content
+// from s and save the modifications to s when Sync is called.
+func Persistent(s Store) Option {
+	return func(fsys *FS) {
+		fsys.store = s
+	}
+}
+
+// load restores the FS content from its store.
+func (fsys *FS) load() error {
+	type loaded struct {
+		n     *node
+		mtime time.Time
+	}
+	var nodes []loaded
+	err := fsys.store.Load(func(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+		if name == "." {
+			return nil
+		}
+		if mode.IsDir() {
+			if err := fsys.Mkdir(name, mode); err != nil {
+				return err
+			}
+		} else {
+			f, err := fsys.OpenWithFinalizer(name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, mode, nil)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f.(io.Writer), r)
+			if err1 := f.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				return err
+			}
+		}
+		nodes = append(nodes, loaded{fsys.find(&fsys.root, name), modTime})
+		return nil
+	})
+	// the directory modification times are updated when the content is
+	// loaded so restore them at the end
+	for _, l := range nodes {
+		l.n.modSec = l.mtime.Unix()
+		l.n.modNsec = l.mtime.Nanosecond()
+	}
+	setDirty(&fsys.root, false)
+	return err
+}
+
+// deleted records the name of a node removed from the tree so it can be
+// deleted from the store. fsys.mu must be locked.
+func (fsys *FS) deleted(name string) {
+	if fsys.store != nil {
+		fsys.trash = append(fsys.trash, name)
+	}
+}
+
+// markDirty marks n as modified since the last Sync. It does nothing if the FS
+// has no store (n has no metadata for the dirty flag). The n.mu must be locked.
+func markDirty(n *node) {
+	if n.ext != nil {
+		n.ext.dirty = true
+	}
+}
+
+// setDirty sets the dirty flag of n and all its descendants.
+func setDirty(n *node, dirty bool) {
+	n.mu.Lock()
+	if n.ext != nil {
+		n.ext.dirty = dirty
+	}
+	list := n.list
+	n.mu.Unlock()
+	for _, n := range list {
+		setDirty(n, dirty)
+	}
+}
+
+// Sync writes the modifications made since the last Sync to the store set by
+// the Persistent option. It does nothing if the FS has no store. If New
+// couldn't load the FS content Sync returns the load error and doesn't modify
+// the store to avoid overwriting the stored data with the incomplete content.
+// The tree modifications are blocked during Sync but the files can be read
+// and written. A file modified during Sync stays dirty.
+func (fsys *FS) Sync() error {
+	if fsys.store == nil {
+		return nil
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.loadErr != nil {
+		return fsys.loadErr
+	}
+	for len(fsys.trash) > 0 {
+		if err := fsys.store.Delete(fsys.trash[0]); err != nil {
+			return &fs.PathError{Op: "sync", Path: fsys.trash[0], Err: err}
+		}
+		fsys.trash = fsys.trash[1:]
+	}
+	fsys.trash = nil
+	return fsys.sync(&fsys.root, "")
+}
+
+// sync saves the dirty content of the directory dir to the store.
+func (fsys *FS) sync(dir *node, path string) error {
+	dir.mu.RLock()
+	list := dir.list
+	dir.mu.RUnlock()
+	for _, n := range list {
+		name := n.name
+		if path != "" {
+			name = path + "/" + name
+		}
+		n.mu.RLock()
+		dirty, gen := n.ext.dirty, n.gen
+		mtime := time.Unix(n.modSec, int64(n.modNsec))
+		n.mu.RUnlock()
+		var err error
+		if n.fileFS == nil {
+			if dirty {
+				err = fsys.store.Save(name, fs.ModeDir|0777, mtime, nil)
+			}
+			if err == nil {
+				err = fsys.sync(n, name)
+			}
+		} else if dirty {
+			f := fsys.open(n, name, nil, syscall.O_RDONLY, 0)
+			err = fsys.store.Save(name, 0666, mtime, f.(io.Reader))
+			f.Close()
+		}
+		if err != nil {
+			if _, ok := err.(*fs.PathError); !ok {
+				err = &fs.PathError{Op: "sync", Path: name, Err: err}
+			}
+			return err
+		}
+		if dirty {
+			n.mu.Lock()
+			if n.gen == gen {
+				n.ext.dirty = false
+			}
+			n.mu.Unlock()
+		}
+	}
+	return nil
+}
@@ -6,110 +6,287 @@
 package ramfs
 
 import (
+	"hash/maphash"
 	"io/fs"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // A node represents a filesystem node
 type node struct {
-	fileFS *FS // non-nil for file, nil for directory
+	fileFS *FS    // non-nil for file, nil for directory
+	id     uint64 // unique node identifier, see NodeInfo
+	opened int32  // number of open files, accessed atomically
 
-	// the following three fields are protected by mx in the parent node
+	// the following field is protected by mu in the parent node, it can be
+	// modified only with the FS mu locked
 	name string
-	next *node // points to the next node in the same directory
 
 	mu      sync.RWMutex // protects the following fields
-	list    *node
-	data    []byte
+	ext     *nodeExt     // optional metadata or nil
+	list    []*node      // directory entries sorted by name
+	data    [][]byte     // file content stored in chunks
+	alloc   int          // memory used by data chunks
+	size    int          // file size
+	gen     uint32       // incremented on every data modification
+	removed bool         // node was removed from the tree
 	modSec  int64
 	modNsec int
 }
 
-const (
-	msbit      = ^uintptr(0) - ^uintptr(0)>>1
-	logPtrSize = 2*(msbit>>31&1) + 3*(msbit>>63&1) + 4*(msbit>>127&1)
-
-	ptrSize  = 1 << logPtrSize
-	intSize  = ptrSize
-	strSize  = 2 * ptrSize
-	sliSize  = 3 * ptrSize
-	lockSize = 6 * 4
-
-	nodeSize = ptrSize + strSize + ptrSize + lockSize + ptrSize + sliSize + 8 + intSize
-
-	emptyFileSize = nodeSize
-	dirSize       = nodeSize
-)
-
-func size(n *node) int64 {
-	size := dirSize
-	if n.fileFS != nil {
-		n.mu.RLock()
-		size = emptyFileSize + cap(n.data)
-		n.mu.RUnlock()
-	}
-	return int64(size)
+// A nodeExt contains the node metadata used only by the optional features.
+// Every node of the FS created with the Checksums, Dedup, EvictLRU or
+// Persistent option has it, the other nodes get it when needed by SetExpiry or
+// Clone. The ext pointer allocated with the node never changes so the used
+// field can be accessed without locking the node.
+type nodeExt struct {
+	used    atomic.Uint64 // FS clock at the last open, see EvictLRU
+	shared  []uint64      // bitmap of chunks shared with other files
+	hash    uint64        // hash of the file data if FS.dedup is set or 0
+	expires int64         // expiry time in Unix nanoseconds or 0
+	crc     uint32        // CRC-32 (IEEE) of the file data if FS.crc is set
+	hashGen uint32        // gen at the time of hash calculation
+	dirty   bool          // node was modified since the last Sync
 }
 
 func stat(n *node) *fileInfo {
 	fi := new(fileInfo)
 	fi.name = n.name
+	fi.sys.ID = n.id
 	n.mu.RLock()
+	fi.sys.Gen = n.gen
 	fi.isDir = n.fileFS == nil
 	fi.modSec = n.modSec
 	fi.modNsec = n.modNsec
-	fi.size = len(n.data)
+	fi.size = n.size
 	n.mu.RUnlock()
 	return fi
 }
 
 // An FS represents a file system in RAM.
 type FS struct {
-	size    int64
-	maxSize int64
-	root    node
-	items   int32
-	name    string
+	mu       sync.Mutex // serializes modifications of the directory tree
+	size     int64
+	maxSize  int64
+	root     node
+	items    int32
+	lastID   atomic.Uint64
+	clock    atomic.Uint64
+	opened   int32
+	name     string
+	chunkMin int
+	chunkMax int
+	pool     Pool
+	foldCase bool
+	maxName  int
+	nameChar func(r rune) bool
+
+	stats counters
+
+	compressor  Compressor
+	crc         bool
+	protectOpen bool
+	evict       bool
+	dedup       bool
+	extNodes    bool // every node has the nodeExt
+	seed        maphash.Seed
+	dmu         sync.Mutex // serializes deduplication
+
+	store   Store
+	loadErr error    // error returned by store.Load in New
+	trash   []string // names to be deleted from the store by Sync
+}
+
+// An Option configures the FS created by New.
+type Option func(fsys *FS)
+
+// ChunkSize returns an option that makes all file data chunks size bytes long.
+// Small chunks waste less memory at the end of a file but require more
+// allocations (and more memory for the chunk list) to store large files.
+func ChunkSize(size int) Option {
+	return ChunkGrowth(size, size)
+}
+
+// ChunkGrowth returns an option that sets an exponential growth policy. The
+// first chunk of a file has min bytes, every next one is twice as large as the
+// previous one until the max size is reached.
+func ChunkGrowth(min, max int) Option {
+	if min <= 0 || max < min {
+		panic("ramfs: bad chunk size")
+	}
+	return func(fsys *FS) {
+		fsys.chunkMin = min
+		fsys.chunkMax = max
+	}
+}
+
+// PoolSize returns an option that makes the FS keep up to max bytes of the
+// data chunks released by the removed or truncated files and reuse them for new
+// writes. The pooled memory isn't included in the FS usage.
+func PoolSize(max int) Option {
+	return WithPool(&freeList{max: max})
+}
+
+// WithPool returns an option that makes the FS use the provided pool to get the
+// memory for file data and to release the memory of removed or truncated files.
+func WithPool(pool Pool) Option {
+	return func(fsys *FS) {
+		fsys.pool = pool
+	}
+}
+
+// CaseInsensitive returns an option that makes the FS case-insensitive and
+// case-preserving, as FAT file systems are. Names that differ only in case
+// refer to the same file but the name used at creation is kept and reported.
+func CaseInsensitive() Option {
+	return func(fsys *FS) {
+		fsys.foldCase = true
+	}
+}
+
+// MaxNameLen returns an option that limits the length of the names of newly
+// created files and directories to n bytes. Longer names are rejected with
+// ENAMETOOLONG.
+func MaxNameLen(n int) Option {
+	return func(fsys *FS) {
+		fsys.maxName = n
+	}
+}
+
+// NameChars returns an option that restricts the characters that can be used
+// in the names of newly created files and directories to those for which valid
+// returns true. Names containing other characters (or invalid UTF-8) are
+// rejected with EINVAL.
+func NameChars(valid func(r rune) bool) Option {
+	return func(fsys *FS) {
+		fsys.nameChar = valid
+	}
 }
 
-func New(name string, maxSize int64) *FS {
+// ProtectOpen returns an option that makes Remove and Rename fail with EBUSY
+// instead of removing (replacing) an open file or directory.
+func ProtectOpen() Option {
+	return func(fsys *FS) {
+		fsys.protectOpen = true
+	}
+}
+
+// ASCIINames returns an option that restricts the names of newly created files
+// and directories to printable ASCII characters. It replaces NameChars.
+func ASCIINames() Option {
+	return NameChars(func(r rune) bool { return ' ' <= r && r < utf8.RuneSelf-1 })
+}
+
+// New returns a new file system named name that can use up to maxSize bytes of
+// memory. By default the file data is stored in 64-byte chunks. If the
+// Persistent option is used the FS content is loaded from the provided store.
+func New(name string, maxSize int64, opts ...Option) *FS {
 	fsys := new(FS)
 	fsys.maxSize = maxSize
 	fsys.name = name
+	fsys.chunkMin = defaultChunkSize
+	fsys.chunkMax = defaultChunkSize
+	for _, opt := range opts {
+		opt(fsys)
+	}
+	fsys.extNodes = fsys.crc || fsys.dedup || fsys.evict || fsys.store != nil
 	fsys.root.name = "."
+	fsys.root.id = fsys.newID()
+	fsys.root.ext = fsys.newExt()
 	ctime := time.Now()
 	fsys.root.modSec = ctime.Unix()
 	fsys.root.modNsec = ctime.Nanosecond()
+	if fsys.store != nil {
+		fsys.loadErr = fsys.load()
+	}
 	return fsys
 }
 
+// newID returns a new node identifier.
+func (fsys *FS) newID() uint64 {
+	return fsys.lastID.Add(1)
+}
+
+// checkName checks the name of a new node against the FS name rules.
+func (fsys *FS) checkName(name string) error {
+	if fsys.maxName > 0 && len(name) > fsys.maxName {
+		return syscall.ENAMETOOLONG
+	}
+	if fsys.nameChar != nil {
+		if !utf8.ValidString(name) {
+			return syscall.EINVAL
+		}
+		for _, r := range name {
+			if !fsys.nameChar(r) {
+				return syscall.EINVAL
+			}
+		}
+	}
+	return nil
+}
+
+// lookup searches the dir list for a node with a given name. It returns the
+// index of the node found or the index where such node should be inserted.
+func (fsys *FS) lookup(dir *node, name string) (i int, found bool) {
+	cmp := strings.Compare
+	if fsys.foldCase {
+		cmp = compareFold
+	}
+	return slices.BinarySearchFunc(dir.list, name, func(n *node, name string) int {
+		return cmp(n.name, name)
+	})
+}
+
+// compareFold works like strings.Compare but compares the Unicode case folded
+// strings.
+func compareFold(a, b string) int {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		ra = unicode.ToLower(unicode.ToUpper(ra))
+		rb = unicode.ToLower(unicode.ToUpper(rb))
+		if ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	switch {
+	case a != "":
+		return 1
+	case b != "":
+		return -1
+	}
+	return 0
+}
+
 // find searches the tree starting from root directory for a node with a given
 // path name.
-func find(root *node, name string) *node {
+func (fsys *FS) find(root *node, name string) *node {
 	var name1 string
 	if i := strings.IndexByte(name, '/'); i > 0 {
 		name1 = name[i+1:]
 		name = name[:i]
 	}
+	var n *node
 	root.mu.RLock()
-	n := root.list
-	for n != nil {
-		if n.name == name {
-			if len(name1) == 0 {
-				break
-			}
+	if i, ok := fsys.lookup(root, name); ok {
+		n = root.list[i]
+		if len(name1) != 0 {
 			if n.fileFS == nil {
-				n = find(n, name1)
-				break
+				n = fsys.find(n, name1)
+			} else {
+				n = nil
 			}
-			n = nil
-			break
 		}
-		n = n.next
 	}
 	root.mu.RUnlock()
 	return n
@@ -117,28 +294,56 @@ func find(root *node, name string) *node {
 
 // findDir works like path.Split but also searches for a directory starting from
 // root directory and returns the corresponding node if found.
-func findDir(root *node, name string) (dir *node, base string) {
+func (fsys *FS) findDir(root *node, name string) (dir *node, base string) {
 	i := strings.LastIndexByte(name, '/')
 	if i < 0 {
 		return root, name
 	}
-	dir = find(root, name[:i])
+	dir = fsys.find(root, name[:i])
 	if dir == nil || dir.fileFS != nil {
 		return dir, name[:i] // return the directory name
 	}
 	return dir, name[i+1:]
 }
 
-func open(n *node, name string, closed func(), flag, pos int) fs.File {
+func (fsys *FS) open(n *node, name string, closed func(), flag, pos int) fs.File {
+	atomic.AddInt32(&n.opened, 1)
+	atomic.AddInt32(&fsys.opened, 1)
+	if fsys.evict {
+		n.ext.used.Store(fsys.clock.Add(1))
+	}
 	if n.fileFS == nil {
-		return &dir{name: name, n: n, closed: closed}
+		return &dir{fsys: fsys, name: name, n: n, closed: closed}
 	}
-	return &file{name: name, n: n, pos: pos, closed: closed,
-		rdwr: flag & (syscall.O_RDONLY | syscall.O_WRONLY | syscall.O_RDWR)}
+	return &file{name: name, n: n, pos: pos, closed: closed, zidx: -1,
+		rdwr:   flag & (syscall.O_RDONLY | syscall.O_WRONLY | syscall.O_RDWR),
+		append: flag&syscall.O_APPEND != 0}
 }
 
-// OpenWithFinalizer implements the rtos.FS OpenWithFinalizer method.
+// OpenWithFinalizer implements the rtos.FS OpenWithFinalizer method. The
+// O_DIRECTORY flag makes it fail with ENOTDIR if name isn't a directory. The
+// O_NOFOLLOW flag is accepted but has no effect because the FS doesn't support
+// symbolic links.
 func (fsys *FS) OpenWithFinalizer(name string, flag int, _ fs.FileMode, closed func()) (fs.File, error) {
+	if flag&syscall.O_CREAT != 0 {
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+	}
+	n, pos, err := fsys.openNode(name, flag)
+	if err != nil {
+		if closed != nil {
+			closed()
+		}
+		return nil, err
+	}
+	fsys.stats.opens.Add(1)
+	return fsys.open(n, name, closed, flag, pos), nil
+}
+
+// openNode finds or creates (O_CREAT) the named node and truncates it if
+// O_TRUNC is set. It returns the initial file position. fsys.mu must be locked
+// if O_CREAT is set.
+func (fsys *FS) openNode(name string, flag int) (*node, int, error) {
 	var err error
 	{
 		if !fs.ValidPath(name) {
@@ -150,26 +355,42 @@ func (fsys *FS) OpenWithFinalizer(name string, flag int, _ fs.FileMode, closed f
 				err = syscall.ENOTSUP
 				goto error
 			}
-			return open(&fsys.root, name, closed, flag, 0), nil
+			return &fsys.root, 0, nil
 		}
-		if n := find(&fsys.root, name); n != nil {
+		if n := fsys.find(&fsys.root, name); n != nil {
+			if flag&(syscall.O_CREAT|syscall.O_EXCL) == syscall.O_CREAT|syscall.O_EXCL {
+				err = syscall.EEXIST
+				goto error
+			}
+			if flag&syscall.O_DIRECTORY != 0 && n.fileFS != nil {
+				err = syscall.ENOTDIR
+				goto error
+			}
 			pos := 0
 			if flag&(syscall.O_TRUNC|syscall.O_APPEND) != 0 {
 				n.mu.Lock()
 				if flag&syscall.O_TRUNC != 0 {
-					n.data = nil
+					if n.fileFS != nil {
+						atomic.AddInt64(&fsys.size, -contentUsage(n))
+						free(n)
+						markDirty(n)
+					}
 				} else {
-					pos = len(n.data)
+					pos = n.size
 				}
 				n.mu.Unlock()
 			}
-			return open(n, name, closed, flag, pos), nil
+			return n, pos, nil
 		}
 		if flag&syscall.O_CREAT == 0 {
 			err = syscall.ENOENT
 			goto error
 		}
-		dir, base := findDir(&fsys.root, name)
+		if flag&syscall.O_DIRECTORY != 0 {
+			err = syscall.EINVAL // use Mkdir to create a directory
+			goto error
+		}
+		dir, base := fsys.findDir(&fsys.root, name)
 		if dir == nil {
 			name = base
 			err = syscall.ENOENT
@@ -180,39 +401,32 @@ func (fsys *FS) OpenWithFinalizer(name string, flag int, _ fs.FileMode, closed f
 			err = syscall.ENOTDIR
 			goto error
 		}
-		n := find(dir, base)
-		if n == nil {
-			if atomic.AddInt64(&fsys.size, emptyFileSize) > fsys.maxSize {
-				atomic.AddInt64(&fsys.size, -emptyFileSize)
-				err = syscall.ENOSPC
-				goto error
-			}
-			atomic.AddInt32(&fsys.items, 1)
-			mtime := time.Now()
-			n := &node{
-				fileFS:  fsys,
-				name:    base,
-				modSec:  mtime.Unix(),
-				modNsec: mtime.Nanosecond(),
-			}
-			dir.mu.Lock()
-			n.next = dir.list
-			dir.list = n
-			dir.modSec = n.modSec
-			dir.modNsec = n.modNsec
-			dir.mu.Unlock()
-			return open(n, name, closed, flag, 0), nil
+		if err = fsys.checkName(base); err != nil {
+			goto error
+		}
+		if !reserveEvict(fsys, fsys.newNodeUsage(base)) {
+			err = syscall.ENOSPC
+			goto error
 		}
-		if flag&syscall.O_EXCL == 0 {
-			return open(n, name, closed, flag, 0), nil
+		if err = makeRoom(fsys, dir, true); err != nil {
+			atomic.AddInt64(&fsys.size, -fsys.newNodeUsage(base))
+			goto error
 		}
-		err = syscall.EEXIST
+		mtime := time.Now()
+		n := &node{
+			fileFS:  fsys,
+			id:      fsys.newID(),
+			name:    strings.Clone(base),
+			modSec:  mtime.Unix(),
+			modNsec: mtime.Nanosecond(),
+			ext:     fsys.newExt(),
+		}
+		fsys.insert(dir, n)
+		atomic.AddInt32(&fsys.items, 1)
+		return n, 0, nil
 	}
 error:
-	if closed != nil {
-		closed()
-	}
-	return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	return nil, 0, &fs.PathError{Op: "open", Path: name, Err: err}
 }
 
 // Open implements the fs.FS Open method.
@@ -220,6 +434,36 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 	return fsys.OpenWithFinalizer(name, 0, 0, nil)
 }
 
+// Create creates or truncates the named file and opens it for reading and
+// writing. It preallocates memory for sizeHint bytes of data so writing up to
+// sizeHint bytes to the returned file can't fail with ENOSPC and doesn't
+// allocate. If the preallocation fails the file is closed and the error is
+// returned but the created (truncated) file isn't removed.
+func (fsys *FS) Create(name string, sizeHint int) (fs.File, error) {
+	ff, err := fsys.OpenWithFinalizer(name, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := ff.(*file)
+	if !ok {
+		ff.Close() // existing directory
+		return nil, &fs.PathError{Op: "create", Path: name, Err: syscall.EISDIR}
+	}
+	for sizeHint > 0 {
+		f.n.mu.Lock()
+		err = grow(f.n, sizeHint)
+		f.n.mu.Unlock()
+		if err != syscall.ENOSPC || !evict(fsys) {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	return f, nil
+}
+
 // Type implements the rtos.FS Type method.
 func (fsys *FS) Type() string { return "ram" }
 
@@ -238,7 +482,9 @@ func (fsys *FS) Mkdir(name string, _ fs.FileMode) error {
 			err = syscall.EEXIST
 			goto error
 		}
-		dir, base := findDir(&fsys.root, name)
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+		dir, base := fsys.findDir(&fsys.root, name)
 		if dir == nil {
 			name = base
 			err = syscall.ENOENT
@@ -249,66 +495,117 @@ func (fsys *FS) Mkdir(name string, _ fs.FileMode) error {
 			err = syscall.ENOTDIR
 			goto error
 		}
-		if atomic.AddInt64(&fsys.size, dirSize) > fsys.maxSize {
-			atomic.AddInt64(&fsys.size, -dirSize)
+		if fsys.find(dir, base) != nil {
+			err = syscall.EEXIST
+			goto error
+		}
+		if err = fsys.checkName(base); err != nil {
+			goto error
+		}
+		if !reserveEvict(fsys, fsys.newNodeUsage(base)) {
 			err = syscall.ENOSPC
 			goto error
 		}
-		atomic.AddInt32(&fsys.items, 1)
+		if err = makeRoom(fsys, dir, true); err != nil {
+			atomic.AddInt64(&fsys.size, -fsys.newNodeUsage(base))
+			goto error
+		}
 		mtime := time.Now()
-		n := &node{
-			name:    base,
+		fsys.insert(dir, &node{
+			id:      fsys.newID(),
+			name:    strings.Clone(base),
 			modSec:  mtime.Unix(),
 			modNsec: mtime.Nanosecond(),
-		}
-		// BUG: check does dir exist
-		dir.mu.Lock()
-		n.next = dir.list
-		dir.list = n
-		dir.modSec = n.modSec
-		dir.modNsec = n.modNsec
-		dir.mu.Unlock()
+			ext:     fsys.newExt(),
+		})
+		atomic.AddInt32(&fsys.items, 1)
 		return nil
 	}
 error:
 	return &fs.PathError{Op: "mkdir", Path: name, Err: err}
 }
 
+// OpenFiles returns the number of open files and directories, including the
+// removed ones. It helps to find the files that are never closed.
+func (fsys *FS) OpenFiles() int {
+	return int(atomic.LoadInt32(&fsys.opened))
+}
+
+// isBusy reports whether n can't be removed because it is open.
+func (fsys *FS) isBusy(n *node) bool {
+	return fsys.protectOpen && atomic.LoadInt32(&n.opened) != 0
+}
+
 // Usage implements the rtos.UsageFS Usage method.
 func (fsys *FS) Usage() (usedItems, maxItems int, usedBytes, maxBytes int64) {
 	return int(atomic.LoadInt32(&fsys.items)), -1,
 		atomic.LoadInt64(&fsys.size), fsys.maxSize
 }
 
-func unlink(dir *node, name string) *node {
-	dir.mu.Lock()
-	n := dir.list
-	if n != nil {
-		if n.name == name {
-			dir.list = n.next
-		} else {
-			for {
-				prev := n
-				n = n.next
-				if n == nil {
-					break
-				}
-				if n.name == name {
-					prev.next = n.next
-					break
-				}
-			}
-		}
-		if n != nil {
-			mtime := time.Now()
-			dir.modSec = mtime.Unix()
-			dir.modNsec = mtime.Nanosecond()
+// onPath reports whether the directory n is one of the directories on the path
+// name.
+func (fsys *FS) onPath(n *node, name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && fsys.find(&fsys.root, name[:i]) == n {
+			return true
 		}
 	}
+	return false
+}
+
+// insert inserts n into dir and updates the dir modification time. The dir
+// must not contain a node with the same name and must have room for one more
+// entry (see makeRoom).
+func (fsys *FS) insert(dir, n *node) {
+	dir.mu.Lock()
+	i, _ := fsys.lookup(dir, n.name)
+	dir.list = slices.Insert(dir.list, i, n)
+	mtime := time.Now()
+	dir.modSec = mtime.Unix()
+	dir.modNsec = mtime.Nanosecond()
+	markDirty(dir)
+	dir.mu.Unlock()
+}
+
+// unlink removes the node with a given name from dir and updates the dir
+// modification time. It returns the removed node or nil if not found.
+func (fsys *FS) unlink(dir *node, name string) *node {
+	var n *node
+	dir.mu.Lock()
+	if i, ok := fsys.lookup(dir, name); ok {
+		n = dir.list[i]
+		dir.list = slices.Delete(dir.list, i, i+1)
+		mtime := time.Now()
+		dir.modSec = mtime.Unix()
+		dir.modNsec = mtime.Nanosecond()
+		markDirty(dir)
+	}
 	dir.mu.Unlock()
 	return n
 }
 
+// isEmptyDir reports whether n is an empty directory.
+func isEmptyDir(n *node) bool {
+	n.mu.RLock()
+	empty := n.fileFS == nil && len(n.list) == 0
+	n.mu.RUnlock()
+	return empty
+}
+
+// release updates the FS usage after removing n from the tree and frees the
+// memory used by the file data.
+func release(fsys *FS, n *node) {
+	atomic.AddInt32(&fsys.items, -1)
+	n.mu.Lock()
+	atomic.AddInt64(&fsys.size, -(nodeUsage(n.name) + extUsage(n) + contentUsage(n)))
+	if n.fileFS != nil {
+		free(n)
+	}
+	n.removed = true
+	n.mu.Unlock()
+}
+
+// Remove removes the named file or empty directory.
 func (fsys *FS) Remove(name string) error {
 	var err error
 	{
@@ -320,7 +617,9 @@ func (fsys *FS) Remove(name string) error {
 			err = syscall.ENOTSUP
 			goto error
 		}
-		dir, base := findDir(&fsys.root, name)
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+		dir, base := fsys.findDir(&fsys.root, name)
 		if dir == nil {
 			name = base
 			err = syscall.ENOENT
@@ -331,67 +630,135 @@ func (fsys *FS) Remove(name string) error {
 			err = syscall.ENOTDIR
 			goto error
 		}
-		n := unlink(dir, base)
+		n := fsys.find(dir, base)
 		if n == nil {
 			err = syscall.ENOENT
 			goto error
 		}
-		atomic.AddInt32(&fsys.items, -1)
-		atomic.AddInt64(&fsys.size, -size(n))
+		if n.fileFS == nil && !isEmptyDir(n) {
+			err = syscall.ENOTEMPTY
+			goto error
+		}
+		if fsys.isBusy(n) {
+			err = syscall.EBUSY
+			goto error
+		}
+		fsys.unlink(dir, base)
+		release(fsys, n)
+		fsys.deleted(name)
 		return nil
 	}
 error:
 	return &fs.PathError{Op: "remove", Path: name, Err: err}
 }
 
+// Rename renames (moves) oldname to newname. If newname already exists it is
+// replaced if both are files or both are directories and the newname directory
+// is empty.
 func (fsys *FS) Rename(oldname, newname string) error {
-	var (
-		err error
-		n   *node
-	)
-	olddir, oldbase := findDir(&fsys.root, oldname)
+	var err error
+	name := oldname
 	{
-		if olddir == nil || olddir.fileFS != nil {
-			oldbase = oldname
+		if !fs.ValidPath(oldname) || !fs.ValidPath(newname) ||
+			oldname == "." || newname == "." {
+			err = syscall.EINVAL
+			goto error
+		}
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+		olddir, oldbase := fsys.findDir(&fsys.root, oldname)
+		if olddir == nil {
+			name = oldbase
 			err = syscall.ENOENT
 			goto error
 		}
-		n = unlink(olddir, oldbase)
+		if olddir.fileFS != nil {
+			name = oldbase
+			err = syscall.ENOTDIR
+			goto error
+		}
+		n := fsys.find(olddir, oldbase)
 		if n == nil {
-			oldbase = oldname
 			err = syscall.ENOENT
 			goto error
 		}
-		newdir, newbase := findDir(&fsys.root, newname)
+		if n.fileFS == nil && fsys.onPath(n, newname) {
+			err = syscall.EINVAL // can't move a directory into itself
+			goto error
+		}
+		newdir, newbase := fsys.findDir(&fsys.root, newname)
 		if newdir == nil {
-			oldbase = newbase
+			name = newbase
 			err = syscall.ENOENT
 			goto error
 		}
 		if newdir.fileFS != nil {
-			oldbase = newbase
+			name = newbase
 			err = syscall.ENOTDIR
 			goto error
 		}
-		// BUG: may be another file with the same name
-		n.name = newbase
-		newdir.mu.Lock()
-		n.next = newdir.list
-		newdir.list = n
-		mtime := time.Now()
-		newdir.modSec = mtime.Unix()
-		newdir.modNsec = mtime.Nanosecond()
-		newdir.mu.Unlock()
+		old := fsys.find(newdir, newbase)
+		if old == n {
+			if n.name == newbase {
+				return nil
+			}
+			old = nil // only the letter case changes
+		}
+		if old != nil {
+			name = newname
+			if old.fileFS == nil {
+				if n.fileFS != nil {
+					err = syscall.EISDIR
+					goto error
+				}
+				if !isEmptyDir(old) {
+					err = syscall.ENOTEMPTY
+					goto error
+				}
+			} else if n.fileFS == nil {
+				err = syscall.ENOTDIR
+				goto error
+			}
+			if fsys.isBusy(old) {
+				err = syscall.EBUSY
+				goto error
+			}
+		}
+		if err = fsys.checkName(newbase); err != nil {
+			name = newname
+			goto error
+		}
+		if err = makeRoom(fsys, newdir, false); err != nil {
+			goto error
+		}
+		if !reserve(fsys, nodeUsage(newbase)-nodeUsage(oldbase)) {
+			err = syscall.ENOSPC
+			goto error
+		}
+		if old != nil {
+			fsys.unlink(newdir, newbase)
+			release(fsys, old)
+		}
+		fsys.unlink(olddir, oldbase)
+		n.name = strings.Clone(newbase)
+		fsys.insert(newdir, n)
+		fsys.deleted(oldname)
+		setDirty(n, true)
 		return nil
 	}
 error:
-	if n != nil {
-		olddir.mu.Lock()
-		n.next = olddir.list
-		olddir.list = n
-		olddir.mu.Unlock()
-	}
-	return &fs.PathError{Op: "rename", Path: oldbase, Err: err}
+	return &fs.PathError{Op: "rename", Path: name, Err: err}
+}
+
+// NodeInfo is returned by the Sys method of the fs.FileInfo that describes a
+// ramfs file or directory.
+type NodeInfo struct {
+	// ID identifies the file or directory. It doesn't change when the node
+	// is renamed or moved and isn't reused by the FS for other nodes.
+	ID uint64
+
+	// Gen is changed on every modification of the file content.
+	Gen uint32
 }
 
 type fileInfo struct {
@@ -400,12 +767,13 @@ type fileInfo struct {
 	name    string
 	size    int
 	isDir   bool
+	sys     NodeInfo
 }
 
 func (fi *fileInfo) Name() string { return fi.name }
 func (fi *fileInfo) Size() int64  { return int64(fi.size) }
 func (fi *fileInfo) IsDir() bool  { return fi.isDir }
-func (fi *fileInfo) Sys() any     { return nil }
+func (fi *fileInfo) Sys() any     { return fi.sys }
 
 func (fi *fileInfo) ModTime() time.Time {
 	return time.Unix(fi.modSec, int64(fi.modNsec))
@@ -419,5 +787,5 @@ func (fi *fileInfo) Mode() fs.FileMode {
 }
 
 // Additional methods to implement fs.DirEntry interface
-func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode() }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
 func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
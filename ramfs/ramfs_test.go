@@ -6,12 +6,20 @@ package ramfs
 
 import (
 	"bytes"
+	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 )
 
 func checkErr(t *testing.T, err error) {
@@ -52,6 +60,20 @@ func checkUsage(t *testing.T, fsys *FS, usedItems int, usedBytes, maxBytes int)
 	}
 }
 
+func nop() {}
+
+// dataUsage returns the memory used by the file data stored in chunks of the
+// total size chunkBytes, referenced by the chunk list of capacity listCap.
+func dataUsage(listCap, chunkBytes int) int {
+	return roundAlloc(listCap*sliSize) + chunkBytes
+}
+
+// dirUsage returns the memory used by the list of directory of capacity
+// listCap.
+func dirUsage(listCap int) int {
+	return roundAlloc(listCap * ptrSize)
+}
+
 type rwFile interface {
 	fs.File
 	io.Writer
@@ -60,7 +82,7 @@ type rwFile interface {
 func TestFS(t *testing.T) {
 	const maxSize = 1024
 
-	ramfs := New(maxSize)
+	ramfs := New("ram", maxSize)
 	open := func(name string, flags int, perm fs.FileMode) (rwFile, error) {
 		f, err := ramfs.OpenWithFinalizer(name, flags, perm, nop)
 		if f == nil {
@@ -76,10 +98,11 @@ func TestFS(t *testing.T) {
 	checkErr(t, err)
 	data := []byte("test1234\n")
 	_, err = f.Write([]byte("test\n"))
-	expectErr(t, syscall.ENOTSUP, err)
+	expectErr(t, syscall.EBADF, err)
 	checkErr(t, f.Close())
 
-	checkUsage(t, ramfs, 1, emptyFileSize, maxSize)
+	fileA := int(nodeUsage("a.txt"))
+	checkUsage(t, ramfs, 1, fileA+dirUsage(1), maxSize)
 
 	f, err = open("a.txt", syscall.O_CREAT|syscall.O_EXCL, 0)
 	expectErr(t, syscall.EEXIST, err)
@@ -90,7 +113,7 @@ func TestFS(t *testing.T) {
 	checkWrite(t, f, data)
 	checkErr(t, f.Close())
 
-	checkUsage(t, ramfs, 1, emptyFileSize+2*len(data), maxSize)
+	checkUsage(t, ramfs, 1, fileA+dataUsage(1, defaultChunkSize)+dirUsage(1), maxSize)
 
 	buf := make([]byte, 100)
 	f, err = open("a.txt", 0, 0)
@@ -106,22 +129,25 @@ func TestFS(t *testing.T) {
 	checkWrite(t, f, data)
 	checkErr(t, f.Close())
 
-	checkUsage(t, ramfs, 1, emptyFileSize+2*len(data), maxSize)
+	checkUsage(t, ramfs, 1, fileA+dataUsage(1, defaultChunkSize)+dirUsage(1), maxSize)
 
 	f, err = open("a.txt", 0, 0)
 	checkErr(t, err)
 	checkRead(t, f, buf, data)
+	checkRead(t, f, buf, data)
 	_, err = f.Read(buf)
 	expectErr(t, io.EOF, err)
 	checkErr(t, f.Close())
 
 	checkErr(t, ramfs.Mkdir("D", 0))
 
-	checkUsage(t, ramfs, 2, emptyFileSize+2*len(data)+dirSize, maxSize)
+	dirD := int(nodeUsage("D"))
+	checkUsage(t, ramfs, 2, fileA+dataUsage(1, defaultChunkSize)+dirD+dirUsage(2), maxSize)
 
 	checkErr(t, ramfs.Rename("a.txt", "D/b.txt"))
 
-	checkUsage(t, ramfs, 2, emptyFileSize+2*len(data)+dirSize, maxSize)
+	fileB := int(nodeUsage("b.txt"))
+	checkUsage(t, ramfs, 2, fileB+dataUsage(1, defaultChunkSize)+dirD+dirUsage(1)+dirUsage(2), maxSize)
 
 	f, err = open("D/b.txt", syscall.O_RDONLY, 0)
 	checkErr(t, err)
@@ -137,5 +163,987 @@ func TestFS(t *testing.T) {
 	expectErr(t, syscall.ENOENT, ramfs.Remove("a.txt"))
 	checkErr(t, ramfs.Remove("D/b.txt"))
 
-	checkUsage(t, ramfs, 1, dirSize, maxSize)
+	checkUsage(t, ramfs, 1, dirD+dirUsage(1)+dirUsage(2), maxSize)
+}
+
+func TestChunks(t *testing.T) {
+	const maxSize = 4096
+
+	for _, opt := range []struct {
+		opt     Option
+		listCap int
+		alloc   int
+	}{
+		{ChunkSize(defaultChunkSize), 3, 3 * defaultChunkSize},
+		{ChunkSize(7), 20, 20 * 8},
+		{ChunkGrowth(16, 64), 6, 16 + 32 + 64 + 64},
+	} {
+		ramfs := New("ram", maxSize, opt.opt)
+		f, err := ramfs.OpenWithFinalizer("big", syscall.O_CREAT|syscall.O_RDWR, 0, nop)
+		checkErr(t, err)
+		data := make([]byte, 5*defaultChunkSize/2)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		checkWrite(t, f.(rwFile), data[:defaultChunkSize-1])
+		checkWrite(t, f.(rwFile), data[defaultChunkSize-1:])
+		checkErr(t, f.Close())
+
+		checkUsage(t, ramfs, 1, int(nodeUsage("big"))+dataUsage(opt.listCap, opt.alloc)+dirUsage(1), maxSize)
+
+		f, err = ramfs.Open("big")
+		checkErr(t, err)
+		buf, err := io.ReadAll(f)
+		checkErr(t, err)
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("read: data mismatch")
+		}
+		checkErr(t, f.Close())
+	}
+}
+
+type countingPool struct {
+	freeList
+	hits int
+}
+
+func (p *countingPool) Get(size int) []byte {
+	buf := p.freeList.Get(size)
+	if buf != nil {
+		p.hits++
+	}
+	return buf
+}
+
+func TestPool(t *testing.T) {
+	const maxSize = 1024
+
+	pool := &countingPool{freeList: freeList{max: 2 * defaultChunkSize}}
+	ramfs := New("ram", maxSize, WithPool(pool))
+	data := bytes.Repeat([]byte{0xff}, 3*defaultChunkSize)
+
+	f, err := ramfs.OpenWithFinalizer("a", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), data)
+	checkErr(t, f.Close())
+	checkErr(t, ramfs.Remove("a"))
+
+	checkUsage(t, ramfs, 0, dirUsage(1), maxSize)
+	if pool.size != 2*defaultChunkSize {
+		t.Fatalf("pool: expected %d B, got %d B", 2*defaultChunkSize, pool.size)
+	}
+
+	f, err = ramfs.OpenWithFinalizer("b", syscall.O_CREAT|syscall.O_RDWR, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), data[:1])
+	checkErr(t, f.Close())
+	if pool.hits != 1 {
+		t.Fatalf("pool: expected 1 hit, got %d", pool.hits)
+	}
+	f, err = ramfs.Open("b")
+	checkErr(t, err)
+	buf, err := io.ReadAll(f)
+	checkErr(t, err)
+	if len(buf) != 1 {
+		t.Fatalf("read: expected 1 byte, got %d", len(buf))
+	}
+	checkErr(t, f.Close())
+}
+
+func TestDir(t *testing.T) {
+	const maxSize = 1 << 20
+
+	ramfs := New("ram", maxSize)
+	checkErr(t, ramfs.Mkdir("log", 0))
+	expectErr(t, syscall.EEXIST, ramfs.Mkdir("log", 0))
+	const n = 500
+	for i := n - 1; i >= 0; i-- {
+		name := fmt.Sprintf("log/%03d", i)
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT, 0, nop)
+		checkErr(t, err)
+		checkErr(t, f.Close())
+	}
+	checkErr(t, ramfs.Remove("log/100"))
+	checkErr(t, ramfs.Rename("log/200", "log/100"))
+	checkErr(t, ramfs.Rename("log/300", "log/100"))
+	expectErr(t, syscall.ENOTEMPTY, ramfs.Remove("log"))
+	expectErr(t, syscall.EISDIR, ramfs.Rename("log/400", "log"))
+	expectErr(t, syscall.EINVAL, ramfs.Rename("log", "log/x"))
+
+	f, err := ramfs.OpenWithFinalizer("log/400", syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkErr(t, ramfs.Remove("log/400"))
+	checkWrite(t, f.(rwFile), []byte("abc")) // not accounted in the FS usage
+	checkErr(t, f.Close())
+
+	d, err := ramfs.Open("log")
+	checkErr(t, err)
+	var names []string
+	for {
+		de, err := d.(fs.ReadDirFile).ReadDir(7)
+		if err == io.EOF {
+			break
+		}
+		checkErr(t, err)
+		for _, e := range de {
+			names = append(names, e.Name())
+		}
+	}
+	checkErr(t, d.Close())
+	var expected []string
+	for i := 0; i < n; i++ {
+		if i != 200 && i != 300 && i != 400 {
+			expected = append(expected, fmt.Sprintf("%03d", i))
+		}
+	}
+	if !slices.Equal(names, expected) {
+		t.Fatalf("readdir: expected %v, got %v", expected, names)
+	}
+	items, used := walk(&ramfs.root)
+	if items != 1+n-3 {
+		t.Fatalf("expected %d items, got %d", 1+n-3, items)
+	}
+	checkUsage(t, ramfs, items, int(used-nodeUsage(".")), maxSize)
+}
+
+func TestFSTest(t *testing.T) {
+	ramfs := New("ram", 1<<20)
+	checkErr(t, ramfs.Mkdir("empty", 0))
+	checkErr(t, ramfs.Mkdir("etc", 0))
+	checkErr(t, ramfs.Mkdir("etc/net", 0))
+	files := map[string]string{
+		"hello.txt":      "Hello, World!\n",
+		"etc/passwd":     "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/net/ifaces": string(bytes.Repeat([]byte("0123456789"), 50)),
+		"etc/zero":       "",
+	}
+	var expected []string
+	for name, data := range files {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), []byte(data))
+		checkErr(t, f.Close())
+		expected = append(expected, name)
+	}
+	expected = append(expected, "empty", "etc", "etc/net")
+	checkErr(t, fstest.TestFS(ramfs, expected...))
+	if n := ramfs.OpenFiles(); n != 0 {
+		t.Fatalf("%d files left open", n)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	const maxSize = 1024
+
+	ramfs := New("ram", maxSize)
+	f, err := ramfs.Create("fw.bin", 300)
+	checkErr(t, err)
+	checkUsage(t, ramfs, 1, int(nodeUsage("fw.bin"))+dataUsage(5, 5*defaultChunkSize)+dirUsage(1), maxSize)
+	data := bytes.Repeat([]byte{0x5a}, 300)
+	checkWrite(t, f.(rwFile), data)
+	checkErr(t, f.Close())
+	checkUsage(t, ramfs, 1, int(nodeUsage("fw.bin"))+dataUsage(5, 5*defaultChunkSize)+dirUsage(1), maxSize)
+
+	_, err = ramfs.Create("fw.bin", maxSize)
+	expectErr(t, syscall.ENOSPC, err)
+	checkUsage(t, ramfs, 1, int(nodeUsage("fw.bin"))+dirUsage(1), maxSize)
+
+	checkErr(t, ramfs.Mkdir("dir", 0))
+	_, err = ramfs.Create("dir", 0)
+	expectErr(t, syscall.EISDIR, err)
+}
+
+func TestAppend(t *testing.T) {
+	ramfs := New("ram", 4096)
+	open := func() rwFile {
+		f, err := ramfs.OpenWithFinalizer("log", syscall.O_CREAT|syscall.O_WRONLY|syscall.O_APPEND, 0, nop)
+		checkErr(t, err)
+		return f.(rwFile)
+	}
+	f1, f2 := open(), open()
+	checkWrite(t, f1, []byte("a1\n"))
+	checkWrite(t, f2, []byte("b1\n"))
+	checkWrite(t, f1, []byte("a2\n"))
+	checkWrite(t, f2, []byte("b2\n"))
+	checkErr(t, f1.Close())
+	checkErr(t, f2.Close())
+
+	f, err := ramfs.Open("log")
+	checkErr(t, err)
+	buf, err := io.ReadAll(f)
+	checkErr(t, err)
+	checkErr(t, f.Close())
+	if expect := "a1\nb1\na2\nb2\n"; string(buf) != expect {
+		t.Fatalf("read: expected %q, got %q", expect, buf)
+	}
+}
+
+// walk returns the number of items and the number of bytes used by the tree.
+func walk(n *node) (items int, used int64) {
+	n.mu.RLock()
+	used = nodeUsage(n.name) + extUsage(n) + contentUsage(n)
+	for _, e := range n.list {
+		i, u := walk(e)
+		items += 1 + i
+		used += u
+	}
+	n.mu.RUnlock()
+	return
+}
+
+func TestConcurrent(t *testing.T) {
+	const maxSize = 1 << 20
+
+	ramfs := New("ram", maxSize)
+	names := []string{"a", "b", "c", "d", "d/a", "d/b", "e", "e/a"}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				name := names[rnd.Intn(len(names))]
+				switch rnd.Intn(5) {
+				case 0:
+					ramfs.Mkdir(name, 0)
+				case 1:
+					ramfs.Remove(name)
+				case 2:
+					ramfs.Rename(name, names[rnd.Intn(len(names))])
+				default:
+					f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+					if err == nil {
+						if w, ok := f.(io.Writer); ok {
+							w.Write([]byte(name))
+						}
+						f.Close()
+					}
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	items, used := walk(&ramfs.root)
+	checkUsage(t, ramfs, items, int(used-nodeUsage(".")), maxSize)
+	checkErr(t, ramfs.Check())
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	ramfs := New("ram", 4096, CaseInsensitive())
+	checkErr(t, ramfs.Mkdir("Dir", 0))
+	expectErr(t, syscall.EEXIST, ramfs.Mkdir("DIR", 0))
+	f, err := ramfs.OpenWithFinalizer("dir/ReadMe.TXT", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("hello"))
+	checkErr(t, f.Close())
+
+	data, err := fs.ReadFile(ramfs, "DIR/readme.txt")
+	checkErr(t, err)
+	if string(data) != "hello" {
+		t.Fatalf("read: expected %q, got %q", "hello", data)
+	}
+	expectErr(t, syscall.EINVAL, ramfs.Rename("dir", "DIR/sub"))
+	checkErr(t, ramfs.Rename("DIR/readme.txt", "dir/README.txt"))
+	de, err := fs.ReadDir(ramfs, "dir")
+	checkErr(t, err)
+	if len(de) != 1 || de[0].Name() != "README.txt" {
+		t.Fatalf("readdir: expected [README.txt], got %v", de)
+	}
+}
+
+func TestNameRules(t *testing.T) {
+	ramfs := New("ram", 4096, MaxNameLen(12), ASCIINames())
+	create := func(name string) error {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT, 0, nop)
+		if err == nil {
+			err = f.Close()
+		}
+		return err
+	}
+	checkErr(t, create("README.TXT"))
+	expectErr(t, syscall.ENAMETOOLONG, create("LONGNAME.TEXT"))
+	expectErr(t, syscall.EINVAL, create("żółw.txt"))
+	expectErr(t, syscall.EINVAL, create("bad\xff"))
+	expectErr(t, syscall.EINVAL, ramfs.Mkdir("tab\t", 0))
+	expectErr(t, syscall.ENAMETOOLONG, ramfs.Rename("README.TXT", "README.MARKDOWN"))
+	checkErr(t, ramfs.Mkdir("DIR", 0))
+	checkErr(t, ramfs.Rename("README.TXT", "DIR/README.MD"))
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Compress(dst, src []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(src)
+	w.Close()
+	return append(dst, buf.Bytes()...)
+}
+
+func (flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(src)))
+	return append(dst, data...), err
+}
+
+func TestCompression(t *testing.T) {
+	const maxSize = 4096
+
+	ramfs := New("ram", maxSize, ChunkSize(1024), Compression(flateCompressor{}))
+	var data []byte
+	for i := 0; len(data) < 8000; i++ {
+		data = fmt.Appendf(data, "%05d: temperature 21.5 C, humidity 40%%\n", i)
+	}
+	f, err := ramfs.OpenWithFinalizer("log", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	for i := 0; i < len(data); i += 100 {
+		checkWrite(t, f.(rwFile), data[i:min(i+100, len(data))])
+	}
+	checkErr(t, f.Close())
+	_, used := walk(&ramfs.root)
+	checkUsage(t, ramfs, 1, int(used-nodeUsage(".")), maxSize)
+
+	f, err = ramfs.OpenWithFinalizer("log", syscall.O_RDWR, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("XXXXX"))
+	copy(data, "XXXXX")
+	buf := make([]byte, 10)
+	checkRead(t, f, buf, data[5:15])
+	checkErr(t, f.Close())
+
+	f, err = ramfs.Open("log")
+	checkErr(t, err)
+	got, err := io.ReadAll(iotest.OneByteReader(f))
+	checkErr(t, err)
+	checkErr(t, f.Close())
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read: data mismatch")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ramfs := New("ram", 8192, ChunkSize(256), Checksums(), Compression(flateCompressor{}))
+	checkErr(t, ramfs.Mkdir("d", 0))
+	for _, name := range []string{"a", "d/b", "d/c"} {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_RDWR, 0, nop)
+		checkErr(t, err)
+		for i := 0; i < 20; i++ {
+			checkWrite(t, f.(rwFile), []byte(name+" 0123456789abcdef\n"))
+		}
+		checkErr(t, f.Close())
+	}
+	f, err := ramfs.OpenWithFinalizer("a", syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("overwritten"))
+	checkErr(t, f.Close())
+	checkErr(t, ramfs.Check())
+
+	n := ramfs.root.list[0]
+	n.data[0][len(n.data[0])/2] ^= 1 // corrupt the (compressed) file data
+	ramfs.size++
+	err = ramfs.Check()
+	if err == nil {
+		t.Fatal("check: corruption not detected")
+	}
+	for _, s := range []string{"ramfs: a: checksum mismatch", "bytes accounted"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("check: %q not reported in:\n%v", s, err)
+		}
+	}
+}
+
+type storeEntry struct {
+	mode  fs.FileMode
+	mtime time.Time
+	data  string
+}
+
+// mapStore is a Store that keeps the content in a map.
+type mapStore map[string]storeEntry
+
+func (s mapStore) Load(fn func(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error) error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	slices.Sort(names) // a directory goes before its content
+	for _, name := range names {
+		e := s[name]
+		var r io.Reader
+		if !e.mode.IsDir() {
+			r = strings.NewReader(e.data)
+		}
+		if err := fn(name, e.mode, e.mtime, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s mapStore) Save(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+	e := storeEntry{mode: mode, mtime: modTime}
+	if r != nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		e.data = string(data)
+	}
+	s[name] = e
+	return nil
+}
+
+func (s mapStore) Delete(name string) error {
+	for n := range s {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(s, n)
+		}
+	}
+	return nil
+}
+
+func TestPersistent(t *testing.T) {
+	store := mapStore{}
+	ramfs := New("ram", 8192, Persistent(store))
+	checkErr(t, ramfs.Mkdir("d", 0))
+	checkErr(t, ramfs.Mkdir("d/e", 0))
+	for _, name := range []string{"a", "d/b", "d/e/c"} {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), []byte("content of "+name))
+		checkErr(t, f.Close())
+	}
+	if len(store) != 0 {
+		t.Fatal("store modified before Sync")
+	}
+	checkErr(t, ramfs.Sync())
+	if len(store) != 5 || store["d/e/c"].data != "content of d/e/c" {
+		t.Fatalf("sync: bad store content: %v", store)
+	}
+
+	checkErr(t, ramfs.Rename("d", "x"))
+	checkErr(t, ramfs.Remove("a"))
+	f, err := ramfs.OpenWithFinalizer("x/b", syscall.O_WRONLY|syscall.O_APPEND, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte(" modified"))
+	checkErr(t, f.Close())
+	checkErr(t, ramfs.Sync())
+	var names []string
+	for name := range store {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"x", "x/b", "x/e", "x/e/c"}) {
+		t.Fatalf("sync: bad store content: %v", names)
+	}
+
+	restored := New("ram", 8192, Persistent(store))
+	e := store["x/e/c"]
+	delete(store, "x/e/c")
+	checkErr(t, restored.Sync())
+	if _, ok := store["x/e/c"]; ok {
+		t.Fatal("sync: restored file saved again")
+	}
+	store["x/e/c"] = e
+	for name, e := range store {
+		fi, err := fs.Stat(restored, name)
+		checkErr(t, err)
+		if fi.IsDir() != e.mode.IsDir() || !fi.ModTime().Equal(e.mtime) {
+			t.Fatalf("%s: bad restored file info", name)
+		}
+		if !fi.IsDir() {
+			data, err := fs.ReadFile(restored, name)
+			checkErr(t, err)
+			if string(data) != e.data {
+				t.Fatalf("%s: bad restored content: %q", name, data)
+			}
+		}
+	}
+	if string(store["x/b"].data) != "content of d/b modified" {
+		t.Fatalf("x/b: bad stored content: %q", store["x/b"].data)
+	}
+	checkErr(t, restored.Check())
+}
+
+func TestPeek(t *testing.T) {
+	for _, opt := range []Option{ChunkSize(64), Compression(flateCompressor{})} {
+		ramfs := New("ram", 8192, opt)
+		f, err := ramfs.OpenWithFinalizer("f", syscall.O_CREAT|syscall.O_RDWR, 0, nop)
+		checkErr(t, err)
+		data := bytes.Repeat([]byte("0123456789"), 20)
+		checkWrite(t, f.(rwFile), data)
+		checkErr(t, f.Close())
+
+		f, err = ramfs.Open("f")
+		checkErr(t, err)
+		pf := f.(interface {
+			Peek(n int) ([]byte, error)
+			Discard(n int) (int, error)
+		})
+		var got []byte
+		for {
+			p, err := pf.Peek(100)
+			if err == io.EOF {
+				break
+			}
+			checkErr(t, err)
+			if len(p) == 0 || len(p) > 100 {
+				t.Fatalf("peek: bad length %d", len(p))
+			}
+			got = append(got, p...)
+			if _, err = pf.Discard(len(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("peek: data mismatch")
+		}
+		n, err := pf.Discard(1)
+		if n != 0 || err != io.EOF {
+			t.Fatalf("discard: expected 0, EOF, got %d, %v", n, err)
+		}
+		checkErr(t, f.Close())
+	}
+}
+
+func TestIOCopy(t *testing.T) {
+	for _, opt := range []Option{ChunkGrowth(16, 256), Compression(flateCompressor{})} {
+		ramfs := New("ram", 16384, opt, Checksums())
+		f, err := ramfs.OpenWithFinalizer("f", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		data := bytes.Repeat([]byte("0123456789"), 300)
+		n, err := io.Copy(f.(rwFile), iotest.HalfReader(bytes.NewReader(data)))
+		checkErr(t, err)
+		if n != int64(len(data)) {
+			t.Fatalf("copy to file: expected %d bytes, got %d", len(data), n)
+		}
+		checkErr(t, f.Close())
+		checkErr(t, ramfs.Check())
+
+		f, err = ramfs.Open("f")
+		checkErr(t, err)
+		var buf bytes.Buffer
+		n, err = io.Copy(&buf, f)
+		checkErr(t, err)
+		if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("copy from file: data mismatch")
+		}
+		checkErr(t, f.Close())
+	}
+
+	// the file can be read while io.Copy waits for data
+	ramfs := New("ram", 16384, ChunkSize(64))
+	f, err := ramfs.OpenWithFinalizer("f", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(f.(rwFile), pr)
+		done <- err
+	}()
+	pw.Write([]byte("abc"))
+	pw.Write(nil) // wait for the next Read call
+	data, err := fs.ReadFile(ramfs, "f")
+	checkErr(t, err)
+	if string(data) != "abc" {
+		t.Fatalf("copy to file: got %q", data)
+	}
+	pw.Close()
+	checkErr(t, <-done)
+	checkErr(t, f.Close())
+}
+
+func TestCopyFile(t *testing.T) {
+	for _, share := range []bool{false, true} {
+		pool := &countingPool{freeList: freeList{max: 4096}}
+		ramfs := New("ram", 8192, ChunkSize(64), WithPool(pool), Checksums())
+		copyFile := ramfs.CopyFile
+		if share {
+			copyFile = ramfs.Clone
+		}
+		f, err := ramfs.OpenWithFinalizer("a", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		data := bytes.Repeat([]byte("0123456789"), 20)
+		checkWrite(t, f.(rwFile), data)
+		checkErr(t, f.Close())
+		_, _, used, _ := ramfs.Usage()
+
+		checkErr(t, copyFile("b", "a"))
+		_, _, used2, _ := ramfs.Usage()
+		if used2-used < int64(len(data)) {
+			t.Fatalf("%v: usage %d after copy, %d before", share, used2, used)
+		}
+		checkErr(t, ramfs.Check())
+
+		f, err = ramfs.OpenWithFinalizer("b", syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), []byte("XXXXX"))
+		checkErr(t, f.Close())
+		a, err := fs.ReadFile(ramfs, "a")
+		checkErr(t, err)
+		b, err := fs.ReadFile(ramfs, "b")
+		checkErr(t, err)
+		if !bytes.Equal(a, data) || !bytes.Equal(b[5:], data[5:]) || string(b[:5]) != "XXXXX" {
+			t.Fatalf("%v: data mismatch", share)
+		}
+		_, _, used3, _ := ramfs.Usage()
+		if used3 != used2 {
+			t.Fatalf("%v: usage %d after write, %d before", share, used3, used2)
+		}
+		checkErr(t, ramfs.Remove("a"))
+		if share && pool.size != 0 {
+			t.Fatalf("shared chunks put to the pool")
+		}
+		checkErr(t, ramfs.Check())
+
+		expectErr(t, syscall.EINVAL, copyFile("b", "b"))
+		expectErr(t, syscall.ENOENT, copyFile("c", "a"))
+		checkErr(t, ramfs.Mkdir("d", 0))
+		expectErr(t, syscall.EISDIR, copyFile("c", "d"))
+		expectErr(t, syscall.EISDIR, copyFile("d", "b"))
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	ramfs := New("ram", 8192)
+	nodeInfo := func(name string) NodeInfo {
+		fi, err := fs.Stat(ramfs, name)
+		checkErr(t, err)
+		return fi.Sys().(NodeInfo)
+	}
+	checkErr(t, ramfs.Mkdir("d", 0))
+	f, err := ramfs.OpenWithFinalizer("d/a", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkErr(t, f.Close())
+	root, d, a := nodeInfo("."), nodeInfo("d"), nodeInfo("d/a")
+	if root.ID == d.ID || d.ID == a.ID || root.ID == a.ID {
+		t.Fatalf("non-unique IDs: %d, %d, %d", root.ID, d.ID, a.ID)
+	}
+	checkErr(t, ramfs.Rename("d/a", "b"))
+	b := nodeInfo("b")
+	if b != a {
+		t.Fatalf("node info changed by rename: %+v, %+v", a, b)
+	}
+	f, err = ramfs.OpenWithFinalizer("b", syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("data"))
+	checkErr(t, f.Close())
+	if b1 := nodeInfo("b"); b1.ID != b.ID || b1.Gen == b.Gen {
+		t.Fatalf("bad node info after write: %+v, %+v", b, b1)
+	}
+	checkErr(t, ramfs.Remove("b"))
+	f, err = ramfs.OpenWithFinalizer("b", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkErr(t, f.Close())
+	if nodeInfo("b").ID == b.ID {
+		t.Fatalf("ID reused")
+	}
+}
+
+func TestProtectOpen(t *testing.T) {
+	ramfs := New("ram", 8192, ProtectOpen())
+	checkErr(t, ramfs.Mkdir("d", 0))
+	f, err := ramfs.OpenWithFinalizer("a", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	d, err := ramfs.Open("d")
+	checkErr(t, err)
+	if n := ramfs.OpenFiles(); n != 2 {
+		t.Fatalf("expected 2 open files, got %d", n)
+	}
+	expectErr(t, syscall.EBUSY, ramfs.Remove("a"))
+	expectErr(t, syscall.EBUSY, ramfs.Remove("d"))
+	checkErr(t, ramfs.Mkdir("e", 0))
+	expectErr(t, syscall.EBUSY, ramfs.Rename("e", "d"))
+	checkErr(t, ramfs.Rename("a", "b")) // renaming an open file is allowed
+	checkErr(t, f.Close())
+	checkErr(t, d.Close())
+	if n := ramfs.OpenFiles(); n != 0 {
+		t.Fatalf("expected no open files, got %d", n)
+	}
+	checkErr(t, ramfs.Remove("b"))
+	checkErr(t, ramfs.Rename("e", "d"))
+}
+
+func TestCompact(t *testing.T) {
+	for _, c := range []Compressor{nil, flateCompressor{}} {
+		opts := []Option{ChunkSize(64)}
+		if c != nil {
+			opts = append(opts, Compression(c))
+		}
+		ramfs := New("ram", 16384, opts...)
+		for i := 0; i < 10; i++ {
+			checkErr(t, ramfs.Mkdir(fmt.Sprint("d", i), 0))
+		}
+		for i := 1; i < 10; i++ {
+			checkErr(t, ramfs.Remove(fmt.Sprint("d", i)))
+		}
+		f, err := ramfs.Create("d0/a", 1000)
+		checkErr(t, err)
+		data := bytes.Repeat([]byte("0123456789"), 10)
+		checkWrite(t, f.(rwFile), data)
+		checkErr(t, f.Close())
+		if ramfs.Compact() <= 0 {
+			t.Fatalf("%v: nothing reclaimed", c)
+		}
+		checkErr(t, ramfs.Check())
+		if c == nil {
+			items, used := walk(&ramfs.root)
+			expected := int(used - nodeUsage("."))
+			if expected != int(nodeUsage("d0")+nodeUsage("a"))+2*dirUsage(1)+dataUsage(2, 2*64) {
+				t.Fatalf("bad usage after compact: %d", expected)
+			}
+			checkUsage(t, ramfs, items, expected, 16384)
+		}
+		if ramfs.Compact() != 0 {
+			t.Fatalf("%v: second compact reclaimed memory", c)
+		}
+		got, err := fs.ReadFile(ramfs, "d0/a")
+		checkErr(t, err)
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%v: data mismatch", c)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	ramfs := New("ram", 1024)
+	f, err := ramfs.OpenWithFinalizer("a", syscall.O_CREAT|syscall.O_RDWR, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("0123456789"))
+	checkWrite(t, f.(rwFile), []byte("abcdef"))
+	_, err = f.(rwFile).Write(make([]byte, 2048))
+	expectErr(t, syscall.ENOSPC, err)
+	checkErr(t, f.Close())
+	_, err = ramfs.Open("b")
+	expectErr(t, syscall.ENOENT, err)
+	data, err := fs.ReadFile(ramfs, "a")
+	checkErr(t, err)
+	st := ramfs.Stats()
+	expected := Stats{
+		Opens:        2,
+		Reads:        st.Reads, // depends on the fs.ReadFile implementation
+		Writes:       2,        // the failed write isn't counted
+		BytesRead:    uint64(len(data)),
+		BytesWritten: 16,
+		NoSpace:      1,
+	}
+	if st != expected || st.Reads == 0 {
+		t.Fatalf("expected %+v, got %+v", expected, st)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ramfs := New("ram", 8192, ProtectOpen())
+	checkErr(t, ramfs.Mkdir("cache", 0))
+	checkErr(t, ramfs.Mkdir("cache/d", 0))
+	for _, name := range []string{"a", "cache/b", "cache/d/c", "cache/d/e"} {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), []byte("data"))
+		checkErr(t, f.Close())
+	}
+	_, _, empty, _ := New("ram", 8192).Usage()
+	now := time.Now()
+	checkErr(t, ramfs.SetExpiry("cache/b", now.Add(time.Second)))
+	checkErr(t, ramfs.SetExpiry("cache/d", now.Add(2*time.Second)))
+	checkErr(t, ramfs.SetExpiry("a", now.Add(time.Second)))
+	checkErr(t, ramfs.SetExpiry("a", time.Time{}))
+	expectErr(t, syscall.ENOENT, ramfs.SetExpiry("x", now))
+
+	if n := ramfs.Expire(now); n != 0 {
+		t.Fatalf("expected nothing removed, got %d", n)
+	}
+	if n := ramfs.Expire(now.Add(time.Second)); n != 1 {
+		t.Fatalf("expected 1 removed, got %d", n)
+	}
+	f, err := ramfs.Open("cache/d/e")
+	checkErr(t, err)
+	if n := ramfs.Expire(now.Add(time.Hour)); n != 0 {
+		t.Fatalf("expected open directory kept, got %d removed", n)
+	}
+	checkErr(t, f.Close())
+	if n := ramfs.Expire(now.Add(time.Hour)); n != 3 {
+		t.Fatalf("expected 3 removed, got %d", n)
+	}
+	for _, name := range []string{"cache/b", "cache/d"} {
+		_, err := fs.Stat(ramfs, name)
+		expectErr(t, fs.ErrNotExist, err)
+	}
+	checkErr(t, ramfs.Check())
+	if _, _, used, _ := ramfs.Usage(); used == empty {
+		t.Fatalf("too much removed")
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	ramfs := New("ram", 4608, ChunkSize(256), EvictLRU())
+	checkErr(t, ramfs.Mkdir("d", 0))
+	data := bytes.Repeat([]byte{'x'}, 1000)
+	write := func(name string) {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), data)
+		checkErr(t, f.Close())
+	}
+	write("a")
+	write("d/b")
+	write("c")
+	_, err := fs.ReadFile(ramfs, "a") // a is now more recently used than d/b
+	checkErr(t, err)
+	f, err := ramfs.Open("c") // c is open so it can't be evicted
+	checkErr(t, err)
+	write("e")
+	for _, name := range []string{"a", "c", "d", "e"} {
+		_, err := fs.Stat(ramfs, name)
+		checkErr(t, err)
+	}
+	_, err = fs.Stat(ramfs, "d/b")
+	expectErr(t, fs.ErrNotExist, err)
+	if st := ramfs.Stats(); st.Evictions != 1 || st.NoSpace != 0 {
+		t.Fatalf("bad stats: %+v", st)
+	}
+	checkErr(t, ramfs.Check())
+
+	// evicting all files that aren't open doesn't help
+	g, err := ramfs.OpenWithFinalizer("e", syscall.O_WRONLY|syscall.O_APPEND, 0, nop)
+	checkErr(t, err)
+	_, err = g.(rwFile).Write(make([]byte, 4608))
+	expectErr(t, syscall.ENOSPC, err)
+	_, err = fs.Stat(ramfs, "a")
+	expectErr(t, fs.ErrNotExist, err)
+	checkErr(t, g.Close())
+	checkErr(t, f.Close())
+	checkErr(t, ramfs.Check())
+}
+
+func TestEvictDedup(t *testing.T) {
+	ramfs := New("ram", 4096, ChunkSize(64), EvictLRU(), Dedup())
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for k := 0; k < 500; k++ {
+				name := fmt.Sprintf("f%d", (i+k)%12)
+				f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY|syscall.O_TRUNC, 0, nop)
+				if err != nil {
+					continue // evicted directory entry or no space for the node
+				}
+				f.(rwFile).Write(data)
+				f.Close()
+			}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("deadlock")
+		}
+	}
+	checkErr(t, ramfs.Check())
+}
+
+func TestDirEntry(t *testing.T) {
+	ramfs := New("ram", 8192)
+	checkErr(t, ramfs.Mkdir("d", 0))
+	f, err := ramfs.OpenWithFinalizer("f", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkWrite(t, f.(rwFile), []byte("data"))
+	checkErr(t, f.Close())
+	de, err := fs.ReadDir(ramfs, ".")
+	checkErr(t, err)
+	if len(de) != 2 || de[0].Name() != "d" || !de[0].IsDir() || de[0].Type() != fs.ModeDir ||
+		de[1].Name() != "f" || de[1].IsDir() || de[1].Type() != 0 {
+		t.Fatalf("bad entries: %v", de)
+	}
+	fi, err := de[1].Info()
+	checkErr(t, err)
+	if fi.Name() != "f" || fi.Size() != 4 || fi.IsDir() {
+		t.Fatalf("bad info: %v", fs.FormatFileInfo(fi))
+	}
+	checkErr(t, ramfs.Remove("f"))
+	_, err = de[1].Info()
+	expectErr(t, fs.ErrNotExist, err)
+}
+
+func TestOpenDirectory(t *testing.T) {
+	ramfs := New("ram", 8192)
+	checkErr(t, ramfs.Mkdir("d", 0))
+	f, err := ramfs.OpenWithFinalizer("f", syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+	checkErr(t, err)
+	checkErr(t, f.Close())
+	for _, name := range []string{".", "d"} {
+		d, err := ramfs.OpenWithFinalizer(name, syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0, nop)
+		checkErr(t, err)
+		checkErr(t, d.Close())
+	}
+	_, err = ramfs.OpenWithFinalizer("f", syscall.O_DIRECTORY, 0, nop)
+	expectErr(t, syscall.ENOTDIR, err)
+	_, err = ramfs.OpenWithFinalizer("e", syscall.O_CREAT|syscall.O_DIRECTORY, 0, nop)
+	expectErr(t, syscall.EINVAL, err)
+	f, err = ramfs.OpenWithFinalizer("f", syscall.O_NOFOLLOW, 0, nop)
+	checkErr(t, err)
+	checkErr(t, f.Close())
+}
+
+func TestDedup(t *testing.T) {
+	for _, c := range []Compressor{nil, flateCompressor{}} {
+		opts := []Option{ChunkSize(64), Dedup(), Checksums()}
+		if c != nil {
+			opts = append(opts, Compression(c))
+		}
+		ramfs := New("ram", 8192, opts...)
+		data := bytes.Repeat([]byte("certificate "), 20)
+		for _, name := range []string{"a", "b", "c"} {
+			f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+			checkErr(t, err)
+			if name == "c" {
+				checkWrite(t, f.(rwFile), data[1:])
+			}
+			checkWrite(t, f.(rwFile), data[:len(data)-1])
+			if name != "c" {
+				checkWrite(t, f.(rwFile), data[len(data)-1:])
+			}
+			checkErr(t, f.Close())
+		}
+		na, nb, nc := ramfs.root.list[0], ramfs.root.list[1], ramfs.root.list[2]
+		if &na.data[0][0] != &nb.data[0][0] {
+			t.Fatalf("%v: a and b not deduplicated", c)
+		}
+		if &na.data[0][0] == &nc.data[0][0] {
+			t.Fatalf("%v: a and c share data", c)
+		}
+		checkErr(t, ramfs.Check())
+
+		f, err := ramfs.OpenWithFinalizer("b", syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), []byte("X"))
+		checkErr(t, f.Close())
+		got, err := fs.ReadFile(ramfs, "a")
+		checkErr(t, err)
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%v: a modified by write to b", c)
+		}
+		checkErr(t, ramfs.Check())
+	}
+
+	// hash collision
+	ramfs := New("ram", 8192, ChunkSize(64), Dedup())
+	data := bytes.Repeat([]byte("certificate "), 20)
+	for _, name := range []string{"a", "b"} {
+		f, err := ramfs.OpenWithFinalizer(name, syscall.O_CREAT|syscall.O_WRONLY, 0, nop)
+		checkErr(t, err)
+		checkWrite(t, f.(rwFile), data)
+		checkErr(t, f.Close())
+		data[0] = 'C'
+	}
+	na, nb := ramfs.root.list[0], ramfs.root.list[1]
+	na.ext.hash = nb.ext.hash
+	nb.ext.hashGen-- // make dedup hash b again
+	dedup(nb, nil)
+	if &na.data[0][0] == &nb.data[0][0] || isShared(na, 0) {
+		t.Fatalf("different content deduplicated")
+	}
+	checkErr(t, ramfs.Check())
 }
@@ -0,0 +1,57 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import "sync/atomic"
+
+// Stats contains the FS operation counters.
+type Stats struct {
+	Opens        uint64 // successfully opened files and directories
+	Reads        uint64 // file read operations that returned data
+	Writes       uint64 // file write operations that stored data
+	BytesRead    uint64 // bytes read from files
+	BytesWritten uint64 // bytes written to files
+	NoSpace      uint64 // memory allocations refused because the FS was full
+	Evictions    uint64 // files removed to make room (see EvictLRU)
+}
+
+// counters holds the FS statistics.
+type counters struct {
+	opens        atomic.Uint64
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	noSpace      atomic.Uint64
+	evictions    atomic.Uint64
+}
+
+// read counts a read operation that returned n bytes.
+func (c *counters) read(n int) {
+	c.reads.Add(1)
+	c.bytesRead.Add(uint64(n))
+}
+
+// write counts a write operation that stored n bytes.
+func (c *counters) write(n int) {
+	c.writes.Add(1)
+	c.bytesWritten.Add(uint64(n))
+}
+
+// Stats returns the current values of the FS operation counters. The counters
+// are updated without stopping the FS so they may be slightly inconsistent with
+// each other.
+func (fsys *FS) Stats() Stats {
+	c := &fsys.stats
+	return Stats{
+		Opens:        c.opens.Load(),
+		Reads:        c.reads.Load(),
+		Writes:       c.writes.Load(),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		NoSpace:      c.noSpace.Load(),
+		Evictions:    c.evictions.Load(),
+	}
+}
@@ -12,6 +12,9 @@ type FS struct {
 	root string
 }
 
+// New returns a new semihosting file system named name. All file names are
+// interpreted relative to the rootDir directory on the host. The rootDir can be
+// given in the host native format, also as a Windows path with a drive letter.
 func New(name, rootDir string) *FS {
 	return &FS{name, rootDir}
 }
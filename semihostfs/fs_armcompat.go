@@ -9,7 +9,6 @@ package semihostfs
 import (
 	"io/fs"
 	"os"
-	"path/filepath"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -55,7 +54,9 @@ func openWithFinalizer(fsys *FS, name string, flag int, _ fs.FileMode, closed fu
 	case ":stdin":
 		mode = 0
 	default:
-		hostPath = filepath.Join(fsys.root, name)
+		if hostPath, err = hostJoin(fsys, name); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
 	}
 	type args struct {
 		path    *byte
@@ -90,7 +91,10 @@ func remove(fsys *FS, name string) error {
 		path    *byte
 		pathLen int
 	}
-	hostPath := filepath.Join(fsys.root, name)
+	hostPath, err := hostJoin(fsys, name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
 	ptr := unsafe.Pointer(&args{
 		unsafe.StringData(hostPath + "\x00"),
 		len(hostPath),
@@ -111,8 +115,14 @@ func rename(fsys *FS, oldname, newname string) error {
 		newName *byte
 		newLen  int
 	}
-	hostOld := filepath.Join(fsys.root, oldname)
-	hostNew := filepath.Join(fsys.root, newname)
+	hostOld, err := hostJoin(fsys, oldname)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	hostNew, err := hostJoin(fsys, newname)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: newname, Err: err}
+	}
 	ptr := unsafe.Pointer(&args{
 		unsafe.StringData(hostOld + "\x00"),
 		len(hostOld),
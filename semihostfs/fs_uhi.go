@@ -9,7 +9,6 @@ package semihostfs
 import (
 	"io/fs"
 	"os"
-	"path/filepath"
 	"syscall"
 	"unsafe"
 )
@@ -27,7 +26,10 @@ func openWithFinalizer(fsys *FS, name string, flag int, mode fs.FileMode, closed
 		hostPath = "/dev/stderr\x00"
 		flag = syscall.O_RDONLY
 	default:
-		hostPath = filepath.Join(fsys.root, name+"\x00")
+		if hostPath, err = hostJoin(fsys, name); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		hostPath += "\x00"
 	}
 	ptr := unsafe.StringData(hostPath)
 	fd := hostCall(
@@ -50,7 +52,11 @@ func mkdir(fsys *FS, name string, mode fs.FileMode) error {
 }
 
 func remove(fsys *FS, name string) error {
-	hostPath := filepath.Join(fsys.root, name+"\x00")
+	hostPath, err := hostJoin(fsys, name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	hostPath += "\x00"
 	ptr := unsafe.StringData(hostPath)
 	errno := hostCall(7, uintptr(unsafe.Pointer(ptr)), 0, 0, ptr)
 	if errno < 0 {
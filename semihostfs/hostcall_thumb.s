@@ -2,6 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build thumb
+
 #include "textflag.h"
 
 // https://github.com/ARM-software/abi-aa/blob/main/semihosting/semihosting.rst
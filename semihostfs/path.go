@@ -0,0 +1,45 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package semihostfs
+
+import (
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// hostJoin translates the slash-separated name to the host path relative to the
+// fsys root directory. The host path separator is inferred from the root: roots
+// that contain backslashes or start with a drive letter (e.g. `C:\files`) are
+// considered Windows paths. Names that could escape the root directory are
+// rejected.
+func hostJoin(fsys *FS, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", syscall.EINVAL
+	}
+	root := fsys.root
+	sep := byte('/')
+	if strings.IndexByte(root, '\\') >= 0 || len(root) >= 2 && root[1] == ':' {
+		// Windows host, backslash and colon (drive letters, alternate data
+		// streams) are special so they can't appear in the name.
+		if strings.ContainsAny(name, `\:`) {
+			return "", syscall.EINVAL
+		}
+		sep = '\\'
+		name = strings.ReplaceAll(name, "/", `\`)
+	}
+	switch {
+	case name == ".":
+		if root == "" {
+			return ".", nil
+		}
+		return root, nil
+	case root == "":
+		return name, nil
+	case root[len(root)-1] == sep || sep == '\\' && strings.IndexByte("/:", root[len(root)-1]) >= 0:
+		return root + name, nil // C:\, C:/ or the drive relative C:
+	}
+	return root + string(sep) + name, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package semihostfs
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestHostJoin(t *testing.T) {
+	tests := []struct {
+		root, name string
+		path       string
+		err        error
+	}{
+		// POSIX
+		{"", ".", ".", nil},
+		{"", "a/b", "a/b", nil},
+		{"/", ".", "/", nil},
+		{"/", "a/b", "/a/b", nil},
+		{"/tmp", "a/b", "/tmp/a/b", nil},
+		{"/tmp/", "a", "/tmp/a", nil},
+		{"/tmp", `a\b`, `/tmp/a\b`, nil},
+		{"/tmp", "a:b", "/tmp/a:b", nil},
+
+		// Windows
+		{`C:\files`, ".", `C:\files`, nil},
+		{`C:\files`, "a/b", `C:\files\a\b`, nil},
+		{`C:\files\`, "a", `C:\files\a`, nil},
+		{`C:\`, "a/b", `C:\a\b`, nil},
+		{"C:/", "a/b", `C:/a\b`, nil},
+		{"C:/files", "a", `C:/files\a`, nil},
+		{"C:", ".", "C:", nil},
+		{"C:", "a/b", `C:a\b`, nil},
+		{`\\host\share`, "a", `\\host\share\a`, nil},
+		{`files\x`, "a", `files\x\a`, nil},
+		{`C:\files`, `a\b`, "", syscall.EINVAL},
+		{`C:\files`, "a:b", "", syscall.EINVAL},
+		{`C:\files`, "D:", "", syscall.EINVAL},
+
+		// invalid names
+		{"/tmp", "", "", syscall.EINVAL},
+		{"/tmp", "..", "", syscall.EINVAL},
+		{"/tmp", "a/..", "", syscall.EINVAL},
+		{"/tmp", "../a", "", syscall.EINVAL},
+		{"/tmp", "a/../b", "", syscall.EINVAL},
+		{"/tmp", "./a", "", syscall.EINVAL},
+		{"/tmp", "/a", "", syscall.EINVAL},
+		{"/tmp", "a/", "", syscall.EINVAL},
+		{"/tmp", "a//b", "", syscall.EINVAL},
+		{`C:\files`, "..", "", syscall.EINVAL},
+		{`C:\files`, "a//b", "", syscall.EINVAL},
+	}
+	for _, tc := range tests {
+		path, err := hostJoin(New("sh", tc.root), tc.name)
+		if path != tc.path || err != tc.err {
+			t.Errorf("hostJoin(%q, %q): expected %q, %v, got %q, %v", tc.root, tc.name, tc.path, tc.err, path, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import "syscall"
+
+// A Discipline implements the processing of the terminal input in the line
+// mode, replacing the built-in line editor. It can be used to implement a
+// custom framing of the input data (e.g. SLIP or AT commands).
+type Discipline interface {
+	// Read reads the input from t and stores the result in p (len(p) > 0).
+	// It's called by the Read method of the open file with the terminal
+	// input locked so it must not call any FS method that locks the input.
+	// Read should keep the data that don't fit in p to return them on the
+	// next call.
+	Read(t Terminal, p []byte) (n int, err error)
+}
+
+// A Terminal gives a Discipline access to the terminal I/O.
+type Terminal struct {
+	f *file
+}
+
+// ReadByte returns the next byte from the terminal input. The input data
+// are buffered and mapped according to the FS CharMap. The signal characters
+// aren't recognized. If the file was opened with O_NONBLOCK ReadByte returns
+// EAGAIN if there is no input data available.
+func (t Terminal) ReadByte() (byte, error) {
+	var buf [1]byte
+	for {
+		if t.f.nonblock {
+			if ok, err := poll(t.f.fs, 0); err != nil {
+				return 0, err
+			} else if !ok {
+				return 0, syscall.EAGAIN
+			}
+		}
+		if _, err := readBuffered(t.f.fs, buf[:]); err != nil {
+			return 0, err
+		}
+		if c, ok := mapIn(t.f.flags(), buf[0]); ok {
+			return c, nil
+		}
+		t.f.fs.stats.dropped.Add(1)
+	}
+}
+
+// Echo writes p to the terminal output if the echo is enabled.
+func (t Terminal) Echo(p []byte) error {
+	if t.f.flags()&echo == 0 {
+		return nil
+	}
+	_, err := write(t.f, p)
+	return err
+}
+
+// Write writes p to the terminal output.
+func (t Terminal) Write(p []byte) (n int, err error) {
+	return write(t.f, p)
+}
+
+// SetDiscipline sets the line discipline used in the line mode. Use nil to
+// restore the built-in line editor.
+func (fsys *FS) SetDiscipline(d Discipline) {
+	fsys.rmu.Lock()
+	fsys.disc = d
+	fsys.rpos = -1
+	fsys.rmu.Unlock()
+}
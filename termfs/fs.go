@@ -9,6 +9,7 @@ package termfs
 import (
 	"io"
 	"io/fs"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,35 +17,93 @@ import (
 
 // An FS provides a file system that represents a terminal device. As the
 // embeded systems rarely require more than one terminal device (console) the
-// FS is very simple and provides only one device file "." which can be opened,
-// written and read concurenly by multiple goroutines.
+// FS is very simple and by default provides only one device file "." which can
+// be opened, written and read concurenly by multiple goroutines. Additional
+// devices can be registered using AddDevice.
 type FS struct {
-	r     io.Reader
-	w     io.Writer
-	name  string
-	rmu   sync.Mutex
-	wmu   sync.Mutex
-	line  []byte
-	rpos  int
-	ansi  [7]byte
-	flags CharMap
+	r      io.Reader
+	w      io.Writer
+	name   string
+	rmu    sync.Mutex
+	wmu    sync.Mutex
+	line   []byte
+	rpos   int
+	lx     int      // cursor position in the unfinished line (see O_NONBLOCK)
+	ovr    bool     // overwrite mode (toggled by the Insert key)
+	ibuf   [32]byte // input buffer (see readBuffered)
+	in     []byte   // unread data in ibuf
+	ierr   error    // input error to return after the data in ibuf
+	ansi   [7]byte
+	flags  CharMap
+	col    int      // output column, used to expand tabs
+	ansist uint8    // ANSI escape sequence parser state (see OutStripANSI)
+	hist   [][]byte // ring of previous lines, hist[hnext] is the next slot
+	hnext  int
+	hlen   int    // number of lines in hist
+	hidx   int    // position in hist during navigation, 0 means the edited line
+	hsave  []byte // the edited line saved during the navigation
+
+	ltime    time.Duration // partial line timeout (see SetLineTimeout)
+	ldiscard bool
+
+	vmin  int           // minimum number of bytes returned by raw Read
+	vtime time.Duration // inter-byte timeout of raw Read
+
+	sigc  [3]byte      // signal characters indexed by Signal
+	nosig bool         // signal characters are ordinary data
+	sig   func(Signal) // signal handler
+
+	tee   io.Writer // protected by wmu
+	disc  Discipline
+	eol   [2]byte // additional line terminators
+	eofc  byte    // EOF character
+	stats counters
+	devmu sync.Mutex
+	devs  map[string]*FS // additional devices (see AddDevice)
+
+	complete func(line []byte, pos int) [][]byte
+	prompt   func() string
+	prompted bool // prompt printed for the current line
 }
 
 // New returns a new terminal file system named name. The r and w correspond
 // to the terminal input and output device.
 func New(name string, r io.Reader, w io.Writer) *FS {
-	return &FS{r: r, w: w, name: name}
+	fsys := &FS{r: r, w: w, name: name}
+	fsys.ansi[0] = '\b' // useful to move cursor back in ANSI DCH sequence
+	fsys.ansi[1] = esc  // ANSI escape character
+	fsys.ansi[2] = '['  // ANSI Control Sequence Introducer
+	fsys.rpos = -1
+	fsys.eofc = '\x04'                          // ^D
+	fsys.sigc = [3]byte{'\x03', '\x1c', '\x1a'} // ^C, ^\, ^Z
+	return fsys
 }
 
-type CharMap uint8
+// A CharMap describes the character mappings performed by the FS on the
+// input and output data (similar to the termios input and output modes).
+type CharMap uint16
 
 const (
-	InCRLF    CharMap = 1 << 0 // map input "\r" to "\n"
-	OutLFCRLF CharMap = 1 << 3 // map output "\n" to "\r\n"
+	InCRLF    CharMap = 1 << 0 // map input "\r" to "\n" (ICRNL)
+	InIgnCR   CharMap = 1 << 1 // ignore input "\r" (IGNCR)
+	InLFCR    CharMap = 1 << 2 // map input "\n" to "\r" (INLCR)
+	OutLFCRLF CharMap = 1 << 3 // map output "\n" to "\r\n" (ONLCR)
+	OutCRLF   CharMap = 1 << 4 // map output "\r" to "\n" (OCRNL)
+	OutLFRet  CharMap = 1 << 5 // output "\n" returns the carriage (ONLRET)
+	OutTabs   CharMap = 1 << 6 // expand output tabs to spaces (XTABS)
 
-	mapFlags = (InCRLF | OutLFCRLF)
-	eof      = 1 << 6
-	echo     = 1 << 7
+	// OutStripANSI removes the ANSI escape sequences from the output. It's
+	// intended for dumb terminals (printers, log collectors) that would print
+	// the escape sequences (colors, cursor movement) as garbage. The line
+	// editing doesn't work properly with this mapping.
+	OutStripANSI CharMap = 1 << 7
+
+	inFlags  = InCRLF | InIgnCR | InLFCR
+	outFlags = OutLFCRLF | OutCRLF | OutLFRet | OutTabs
+	mapFlags = inFlags | outFlags | OutStripANSI
+	lineMode = 1 << 8
+	eof      = 1 << 9
+	echo     = 1 << 10
 )
 
 func (fsys *FS) CharMap() CharMap {
@@ -77,19 +136,20 @@ func (fsys *FS) Echo() bool {
 // to consume data.
 func (fsys *FS) SetEcho(on bool) {
 	fsys.rmu.Lock()
+	fsys.wmu.Lock()
 	if on {
 		fsys.flags |= echo
 	} else {
 		fsys.flags &^= echo
 	}
-	fsys.flags |= echo
+	fsys.wmu.Unlock()
 	fsys.rmu.Unlock()
 }
 
 // LineMode returns the configuration of line mode.
 func (fsys *FS) LineMode() (enabled bool, maxLen int) {
 	fsys.rmu.Lock()
-	enabled = fsys.ansi[0] != 0
+	enabled = fsys.flags&lineMode != 0
 	maxLen = cap(fsys.line)
 	fsys.rmu.Unlock()
 	return
@@ -103,16 +163,19 @@ func (fsys *FS) LineMode() (enabled bool, maxLen int) {
 // In the line mode the terminal input is buffered until new-line character
 // received. Small subset of ANSI terminal codes is supported to enable editing
 // the line before passing it to the reading goroutine. There is also simple one
-// line history implemented (use up, down arrows).
+// line history implemented (use up, down arrows), see also SetHistoryDepth.
+//
+// The line mode can be also enabled or disabled for a single open file using
+// its SetRaw method.
 func (fsys *FS) SetLineMode(enable bool, maxLen int) {
 	fsys.rmu.Lock()
+	fsys.wmu.Lock()
 	if enable {
-		fsys.ansi[0] = '\b' // useful to move cursor back in ANSI DCH sequence
-		fsys.ansi[1] = esc  // ANSI escape character
-		fsys.ansi[2] = '['  // ANSI Control Sequence Introducer
+		fsys.flags |= lineMode
 	} else {
-		fsys.ansi[0] = 0
+		fsys.flags &^= lineMode
 	}
+	fsys.wmu.Unlock()
 	fsys.rpos = -1
 	if maxLen >= 0 {
 		if maxLen == 0 {
@@ -124,16 +187,213 @@ func (fsys *FS) SetLineMode(enable bool, maxLen int) {
 	fsys.rmu.Unlock()
 }
 
+// LineTimeout returns the partial line timeout configuration.
+func (fsys *FS) LineTimeout() (timeout time.Duration, discard bool) {
+	fsys.rmu.Lock()
+	timeout, discard = fsys.ltime, fsys.ldiscard
+	fsys.rmu.Unlock()
+	return
+}
+
+// SetLineTimeout sets the idle timeout for the partially entered line in the
+// line mode. If no input is received for the timeout duration the partial
+// line is delivered to the reader as is (without any line terminator) or, if
+// discard is true, the line is cleared and the reader continues to wait for a
+// new one. The timeout requires the input device to implement the
+// SetReadDeadline method and is ignored otherwise. Use timeout == 0 to disable
+// it (the default).
+func (fsys *FS) SetLineTimeout(timeout time.Duration, discard bool) {
+	fsys.rmu.Lock()
+	fsys.ltime, fsys.ldiscard = timeout, discard
+	fsys.rmu.Unlock()
+}
+
+// LineChars returns the additional line terminators and the EOF character
+// (see SetLineChars).
+func (fsys *FS) LineChars() (eol, eol2, eof byte) {
+	fsys.rmu.Lock()
+	eol, eol2, eof = fsys.eol[0], fsys.eol[1], fsys.eofc
+	fsys.rmu.Unlock()
+	return
+}
+
+// SetLineChars sets the special characters recognized in the line mode. The
+// eol and eol2 characters end the line in addition to '\n' (e.g. use '\r' for
+// the terminals that send CR only, without mapping it by InCRLF). They are
+// stored in the line as received. The eof character (^D by default) ends the
+// line without any terminator and makes the Read that follows the line return
+// io.EOF. Use 0 to disable a character. The characters set here take
+// precedence over the signal characters (see SetSignalChars), e.g. eof set to
+// ^Z disables SigTSTP in the line mode.
+func (fsys *FS) SetLineChars(eol, eol2, eof byte) {
+	fsys.rmu.Lock()
+	fsys.eol = [2]byte{eol, eol2}
+	fsys.eofc = eof
+	fsys.rmu.Unlock()
+}
+
+// HistoryDepth returns the number of lines remembered by the line history.
+func (fsys *FS) HistoryDepth() int {
+	fsys.rmu.Lock()
+	depth := len(fsys.hist)
+	fsys.rmu.Unlock()
+	return depth
+}
+
+// SetHistoryDepth sets the number of lines remembered by the line history. The
+// up and down arrows navigate through the remembered lines, Ctrl+R searches
+// them (reverse incremental search). The depth 0 (the default) selects the
+// simple one line history that reuses the capacity of the line buffer and
+// doesn't require any additional memory (no search). SetHistoryDepth clears
+// the history.
+func (fsys *FS) SetHistoryDepth(depth int) {
+	fsys.rmu.Lock()
+	if depth > 0 {
+		fsys.hist = make([][]byte, depth)
+	} else {
+		fsys.hist = nil
+	}
+	fsys.hnext = 0
+	fsys.hlen = 0
+	fsys.hidx = 0
+	fsys.hsave = nil
+	fsys.rmu.Unlock()
+}
+
+// SetCompleter sets the function called in the line mode when the Tab key is
+// pressed. It receives the edited line and the cursor position and returns the
+// possible completions of the word before the cursor (the text between the
+// last space before pos and pos). The common prefix of the suggestions is
+// inserted into the line. If the word can't be extended this way the
+// suggestions are printed below the line. The complete function is called
+// with the input locked so it must not read from the FS. It must not modify or
+// retain the line. Use nil to disable the completion.
+func (fsys *FS) SetCompleter(complete func(line []byte, pos int) (suggestions [][]byte)) {
+	fsys.rmu.Lock()
+	fsys.complete = complete
+	fsys.rmu.Unlock()
+}
+
+// SetPrompt sets the prompt printed in the line mode before collecting a new
+// line. Use an empty string to disable the prompt.
+func (fsys *FS) SetPrompt(prompt string) {
+	if prompt == "" {
+		fsys.SetPromptFunc(nil)
+	} else {
+		fsys.SetPromptFunc(func() string { return prompt })
+	}
+}
+
+// SetPromptFunc works like SetPrompt but the prompt is obtained by calling the
+// prompt function every time it's printed. The line is redrawn together with
+// the prompt after the history recall and the completion listing. The prompt
+// function is called with the input locked so it must not read from the FS.
+func (fsys *FS) SetPromptFunc(prompt func() string) {
+	fsys.rmu.Lock()
+	fsys.prompt = prompt
+	fsys.prompted = false
+	fsys.rmu.Unlock()
+}
+
+// ReadMin returns the raw mode read configuration (see SetReadMin).
+func (fsys *FS) ReadMin() (min int, timeout time.Duration) {
+	fsys.rmu.Lock()
+	min, timeout = fsys.vmin, fsys.vtime
+	fsys.rmu.Unlock()
+	return
+}
+
+// SetReadMin configures the Read method in the raw mode similarly to the
+// termios VMIN and VTIME parameters. By default (min <= 1) Read returns the
+// data obtained by a single Read call on the underlying reader. If min > 1 Read
+// calls the underlying reader until it obtains at least min bytes (or
+// len(p) bytes if p is shorter) or until there is no new data for the timeout
+// duration after the first byte was received. The timeout requires the
+// underlying reader to implement the SetReadDeadline method and is ignored
+// otherwise. Use timeout == 0 to wait for min bytes without time limit.
+func (fsys *FS) SetReadMin(min int, timeout time.Duration) {
+	fsys.rmu.Lock()
+	fsys.vmin, fsys.vtime = min, timeout
+	fsys.rmu.Unlock()
+}
+
+// AddDevice registers the terminal device dev in fsys under the given name.
+// The name must be a valid file name (see fs.ValidPath) without any slash
+// other than ".". The dev can be created by New and is configured using its
+// own methods, independently of fsys. The device files are opened using the
+// fsys OpenWithFinalizer method while "." always refers to fsys itself (the
+// default console).
+func (fsys *FS) AddDevice(name string, dev *FS) error {
+	var err error
+	if !fs.ValidPath(name) || name == "." || strings.IndexByte(name, '/') >= 0 {
+		err = syscall.EINVAL
+		goto error
+	}
+	fsys.devmu.Lock()
+	if _, ok := fsys.devs[name]; ok {
+		err = syscall.EEXIST
+	} else {
+		if fsys.devs == nil {
+			fsys.devs = make(map[string]*FS)
+		}
+		fsys.devs[name] = dev
+	}
+	fsys.devmu.Unlock()
+	if err == nil {
+		return nil
+	}
+error:
+	return &fs.PathError{Op: "adddevice", Path: name, Err: err}
+}
+
+// RemoveDevice unregisters the named device. The already open device files
+// can still be used.
+func (fsys *FS) RemoveDevice(name string) error {
+	fsys.devmu.Lock()
+	_, ok := fsys.devs[name]
+	delete(fsys.devs, name)
+	fsys.devmu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "removedevice", Path: name, Err: syscall.ENOENT}
+	}
+	return nil
+}
+
+// Device returns the device registered under the given name or nil if there
+// is no such device. The name "." refers to fsys.
+func (fsys *FS) Device(name string) *FS {
+	if name == "." {
+		return fsys
+	}
+	fsys.devmu.Lock()
+	dev := fsys.devs[name]
+	fsys.devmu.Unlock()
+	return dev
+}
+
 // OpenWithFinalizer implements the rtos.FS OpenWithFinalizer method. The name
-// must be ".", the flag can be O_RDWR, O_RDONLY, O_WRONLY, the perm is ignored.
+// must be "." or the name of a device registered by AddDevice, the flag can be
+// O_RDWR, O_RDONLY, O_WRONLY, optionally ORed with O_NONBLOCK, the perm is
+// ignored.
+//
+// The Read method of a file opened with O_NONBLOCK returns EAGAIN instead of
+// waiting for the input data (in the line mode for the complete line). It
+// requires the input device to implement the SetReadDeadline method. The
+// writes always block.
 func (fsys *FS) OpenWithFinalizer(name string, flag int, perm fs.FileMode, closed func()) (fs.File, error) {
-	if name != "." {
+	dev := fsys.Device(name)
+	if dev == nil {
 		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
 	}
+	nonblock := flag&syscall.O_NONBLOCK != 0
+	flag &^= syscall.O_NONBLOCK
 	if flag&^(syscall.O_RDONLY|syscall.O_WRONLY|syscall.O_RDWR) != 0 {
 		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
 	}
-	return &file{fsys, flag, closed}, nil
+	if _, ok := dev.r.(readDeadliner); nonblock && !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	return &file{fs: dev, name: name, flag: flag, nonblock: nonblock, closed: closed}, nil
 }
 
 // Type implements the rtos.FS Type method
@@ -146,15 +406,25 @@ func (fsys *FS) Name() string { return fsys.name }
 func (fsys *FS) Usage() (int, int, int64, int64) { return -1, -1, -1, -1 }
 
 type file struct {
-	fs     *FS
-	flag   int
-	closed func()
+	fs       *FS
+	name     string
+	flag     int
+	nonblock bool // O_NONBLOCK
+	closed   func()
+	raw      int8 // 1: raw mode, -1: line mode, 0: FS default (see SetRaw)
+	echo     int8 // 1: echo on, -1: echo off, 0: FS default (see SetEcho)
+	cmap     CharMap
+	ownMap   bool // cmap overrides the FS CharMap (see SetCharMap)
 }
 
 func wrapErr(op string, err error) error {
 	return &fs.PathError{Op: op, Path: ".", Err: err}
 }
 
+func (f *file) wrapErr(op string, err error) error {
+	return &fs.PathError{Op: op, Path: f.name, Err: err}
+}
+
 func (f *file) Read(p []byte) (n int, err error) {
 	if f.flag == syscall.O_WRONLY {
 		err = syscall.EBADF
@@ -165,97 +435,483 @@ func (f *file) Read(p []byte) (n int, err error) {
 	}
 	{
 		f.fs.rmu.Lock()
-		lineMode := f.fs.ansi[0] != 0
-		flags := f.fs.flags
+		flags := f.flags()
+		lineMode := flags&lineMode != 0
+		if f.raw != 0 {
+			lineMode = f.raw < 0
+		}
 		if f.closed == nil {
 			err = syscall.EBADF
 		} else if !lineMode {
-			n, err = f.fs.r.Read(p)
+			for {
+				if !f.nonblock {
+					n, err = readMin(f.fs, p)
+				} else if ok, perr := poll(f.fs, 0); perr != nil || !ok {
+					n, err = 0, perr
+					if err == nil {
+						err = syscall.EAGAIN
+					}
+				} else {
+					n, err = readBuffered(f.fs, p)
+				}
+				n = filterSignals(f.fs, p[:n])
+				if flags&inFlags != 0 {
+					m := mapInput(flags, p[:n])
+					f.fs.stats.dropped.Add(uint64(n - m))
+					n = m
+				}
+				if n != 0 || err != nil {
+					break
+				}
+			}
+		} else if f.fs.disc != nil {
+			n, err = f.fs.disc.Read(Terminal{f}, p)
 		} else {
 			n, err = readLine(f, p)
 		}
 		f.fs.rmu.Unlock()
-		if !lineMode {
-			if flags&InCRLF != 0 {
-				for i := 0; i < n; i++ {
-					if p[i] == '\r' {
-						p[i] = '\n'
-					}
-				}
-			}
-			if flags&echo != 0 {
-				_, err = write(f, p[:n])
+		f.fs.stats.bytesRead.Add(uint64(n))
+		if !lineMode && flags&echo != 0 && n != 0 {
+			if _, werr := write(f, p[:n]); err == nil {
+				err = werr
 			}
 		}
 	}
 end:
 	if err != nil && err != io.EOF {
-		err = wrapErr("read", err)
+		err = f.wrapErr("read", err)
+	}
+	return n, err
+}
+
+// readMin implements the raw mode Read (see SetReadMin). The fsys.rmu must be
+// locked.
+func readMin(fsys *FS, p []byte) (n int, err error) {
+	want := min(fsys.vmin, len(p))
+	if len(fsys.in) != 0 {
+		// data left in the input buffer by the line mode
+		n = copy(p, fsys.in)
+		fsys.in = fsys.in[n:]
+		if n >= want || fsys.ierr != nil {
+			return n, nil
+		}
+	} else if fsys.ierr != nil {
+		err, fsys.ierr = fsys.ierr, nil
+		return 0, err
+	} else if want <= 1 {
+		return fsys.r.Read(p)
+	}
+	var dr readDeadliner
+	if fsys.vtime > 0 {
+		dr, _ = fsys.r.(readDeadliner)
+	}
+	for n < want {
+		if dr != nil && n != 0 {
+			if err = dr.SetReadDeadline(time.Now().Add(fsys.vtime)); err != nil {
+				break
+			}
+		}
+		var m int
+		m, err = fsys.r.Read(p[n:])
+		n += m
+		if err != nil {
+			if isTimeout(err) && n != 0 {
+				err = nil // inter-byte timeout, return the data received so far
+			}
+			break
+		}
+	}
+	if dr != nil && n != 0 {
+		if derr := dr.SetReadDeadline(time.Time{}); err == nil {
+			err = derr
+		}
 	}
 	return n, err
 }
 
-var crlf = [...]byte{'\r', '\n'}
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+func isTimeout(err error) bool {
+	te, ok := err.(interface{ Timeout() bool })
+	return ok && te.Timeout()
+}
+
+// minPollTimeout is the shortest read deadline used by poll. The readers that
+// use the Go runtime poller (os.File, net.Conn) and net.Pipe fail the read
+// with a past deadline before checking for the available data.
+const minPollTimeout = time.Millisecond
+
+// poll reads the data available on the input device into the input buffer
+// waiting at most timeout for them (timeout == 0 means no waiting, see
+// minPollTimeout). It reports whether the input buffer contains any data (or an
+// error). The input device must implement readDeadliner. The fsys.rmu must be
+// locked.
+func poll(fsys *FS, timeout time.Duration) (bool, error) {
+	if len(fsys.in) != 0 || fsys.ierr != nil {
+		return true, nil
+	}
+	timeout = max(timeout, minPollTimeout)
+	dr := fsys.r.(readDeadliner)
+	if err := dr.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	n, err := fsys.r.Read(fsys.ibuf[:])
+	if derr := dr.SetReadDeadline(time.Time{}); err == nil || isTimeout(err) {
+		err = derr
+	}
+	fsys.in = fsys.ibuf[:n]
+	fsys.ierr = err
+	return n != 0 || err != nil, nil
+}
+
+// readBuffered reads data from the terminal input device through the input
+// buffer. It reads all the data available (up to the buffer size) in one
+// underlying Read call and then returns it from memory. The fsys.rmu must be
+// locked.
+func readBuffered(fsys *FS, p []byte) (n int, err error) {
+	for len(fsys.in) == 0 {
+		if fsys.ierr != nil {
+			err, fsys.ierr = fsys.ierr, nil
+			return 0, err
+		}
+		n, err = fsys.r.Read(fsys.ibuf[:])
+		fsys.in = fsys.ibuf[:n]
+		fsys.ierr = err
+	}
+	n = copy(p, fsys.in)
+	fsys.in = fsys.in[n:]
+	return n, nil
+}
+
+// mapIn maps the input character c according to the CharMap flags. It returns
+// false if c should be ignored.
+func mapIn(flags CharMap, c byte) (byte, bool) {
+	switch {
+	case c == '\r' && flags&InIgnCR != 0:
+		return c, false
+	case c == '\r' && flags&InCRLF != 0:
+		return '\n', true
+	case c == '\n' && flags&InLFCR != 0:
+		return '\r', true
+	}
+	return c, true
+}
+
+// mapInput maps the input data in p according to the CharMap flags. It returns
+// the number of remaining bytes in p.
+func mapInput(flags CharMap, p []byte) int {
+	n := 0
+	for _, c := range p {
+		if c, ok := mapIn(flags, c); ok {
+			p[n] = c
+			n++
+		}
+	}
+	return n
+}
+
+var (
+	crlf   = [...]byte{'\r', '\n'}
+	tab    = [...]byte{'\t'}
+	spaces = [...]byte{' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+)
+
+// mapOut returns the output sequence for the special character c ('\n', '\r'
+// or '\t') and updates the output column. The fsys.wmu must be locked.
+func mapOut(fsys *FS, flags CharMap, c byte) []byte {
+	switch c {
+	case '\n':
+		if flags&(OutLFCRLF|OutLFRet) != 0 {
+			fsys.col = 0
+		}
+		if flags&OutLFCRLF != 0 {
+			return crlf[:]
+		}
+		return crlf[1:]
+	case '\r':
+		if flags&OutCRLF != 0 {
+			if flags&OutLFRet != 0 {
+				fsys.col = 0
+			}
+			return crlf[1:]
+		}
+		fsys.col = 0
+		return crlf[:1]
+	}
+	// tab
+	n := 8 - fsys.col&7
+	fsys.col += n
+	if flags&OutTabs != 0 {
+		return spaces[:n]
+	}
+	return tab[:]
+}
+
+// columns returns the number of columns occupied by the text in p.
+func columns(p []byte) int {
+	n := 0
+	for _, c := range p {
+		if c&0xC0 != 0x80 { // skip UTF-8 continuation bytes
+			n++
+		}
+	}
+	return n
+}
 
 func write(f *file, p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 	f.fs.wmu.Lock()
+	flags := f.flags()
 	if f.closed == nil {
 		err = syscall.EBADF
 		goto end
 	}
-	if f.fs.flags&OutLFCRLF == 0 {
-		n, err = f.fs.w.Write(p)
-		goto end
+	if flags&OutStripANSI != 0 {
+		n, err = writeStripped(f.fs, flags, p)
+	} else {
+		n, err = writeMapped(f.fs, flags, p)
 	}
-	for {
+end:
+	f.fs.wmu.Unlock()
+	if err != nil {
+		err = f.wrapErr("write", err)
+	}
+	return n, err
+}
+
+// Tee returns the writer set by SetTee.
+func (fsys *FS) Tee() io.Writer {
+	fsys.wmu.Lock()
+	tee := fsys.tee
+	fsys.wmu.Unlock()
+	return tee
+}
+
+// writeMapped writes p to the output device performing the output character
+// mapping. The fsys.wmu must be locked.
+func writeMapped(fsys *FS, flags CharMap, p []byte) (n int, err error) {
+	if flags&outFlags == 0 {
+		return fsys.output(p)
+	}
+	// n is the number of bytes of p written so far, a special character
+	// counts as written only when its whole output sequence was written
+	for n < len(p) {
 		m := n
-		for {
-			if p[m] == '\n' {
-				break
-			}
+		for m < len(p) && p[m] != '\n' && p[m] != '\r' && p[m] != '\t' {
 			m++
-			if m == len(p) {
-				break
-			}
 		}
 		if m != n {
-			m, err = f.fs.w.Write(p[n:m])
-			n += m
-			if err != nil {
-				break
+			var k int
+			k, err = fsys.output(p[n:m])
+			fsys.col += columns(p[n : n+k])
+			n += k
+			if err == nil && n != m {
+				err = io.ErrShortWrite
 			}
-			if n == len(p) {
+			if err != nil || n == len(p) {
 				break
 			}
 		}
-		if _, err = f.fs.w.Write(crlf[:]); err != nil {
+		if _, err = fsys.output(mapOut(fsys, flags, p[n])); err != nil {
 			break
 		}
 		n++
-		if n == len(p) {
-			break
+	}
+	return n, err
+}
+
+// ANSI escape sequence parser states
+const (
+	ansiText   = iota
+	ansiEsc    // after ESC
+	ansiCSI    // in control sequence, until the final byte
+	ansiString // in OSC, DCS, etc. until BEL or ST
+	ansiStrEsc // ESC in string, ST if followed by '\\'
+)
+
+// ansiNext returns the next state of the ANSI escape sequence parser.
+func ansiNext(state uint8, c byte) uint8 {
+	switch state {
+	case ansiEsc:
+		switch c {
+		case '[':
+			return ansiCSI
+		case ']', 'P', 'X', '^', '_':
+			return ansiString
+		case esc:
+			return ansiEsc
+		}
+		return ansiText // two character sequence, e.g. ESC 7
+	case ansiCSI:
+		if c >= 0x40 && c <= 0x7e {
+			return ansiText
+		}
+		return ansiCSI
+	case ansiString:
+		switch c {
+		case '\a':
+			return ansiText
+		case esc:
+			return ansiStrEsc
 		}
+		return ansiString
+	case ansiStrEsc:
+		if c == '\\' {
+			return ansiText
+		}
+		return ansiString
 	}
-end:
-	f.fs.wmu.Unlock()
-	if err != nil {
-		err = wrapErr("write", err)
+	if c == esc {
+		return ansiEsc
+	}
+	return ansiText
+}
+
+// writeStripped works like writeMapped but removes the ANSI escape sequences
+// from p. The escape sequences count as written. The parser state is kept
+// between writes so the sequences can be split across them. The fsys.wmu must
+// be locked.
+func writeStripped(fsys *FS, flags CharMap, p []byte) (n int, err error) {
+	for n < len(p) {
+		for n < len(p) && (fsys.ansist != ansiText || p[n] == esc) {
+			fsys.ansist = ansiNext(fsys.ansist, p[n])
+			n++
+		}
+		m := n
+		for m < len(p) && p[m] != esc {
+			m++
+		}
+		if m != n {
+			var k int
+			k, err = writeMapped(fsys, flags, p[n:m])
+			n += k
+			if err != nil {
+				break
+			}
+		}
+	}
+	return n, err
+}
+
+// SetTee sets the writer that receives a copy of everything written to the
+// terminal output device (including the echo and the line editing sequences).
+// It can be used to capture the console session, e.g. to a log file. The
+// errors returned by w are ignored. Use nil to stop mirroring the output.
+func (fsys *FS) SetTee(w io.Writer) {
+	fsys.wmu.Lock()
+	fsys.tee = w
+	fsys.wmu.Unlock()
+}
+
+// output writes p to the terminal output device and mirrors the written bytes
+// to the tee writer. The fsys.wmu must be locked.
+func (fsys *FS) output(p []byte) (int, error) {
+	n, err := fsys.w.Write(p)
+	fsys.stats.bytesWritten.Add(uint64(n))
+	if fsys.tee != nil && n > 0 {
+		fsys.tee.Write(p[:n])
 	}
 	return n, err
 }
 
+// SetWriteDeadline sets the deadline for the writes to the terminal output
+// device, including the echo. It's passed to the underlying io.Writer which
+// must implement the SetWriteDeadline method, otherwise SetWriteDeadline
+// returns ENOTSUP. It's intended to abandon writing to a stalled device: the
+// writes that exceed the deadline return the number of bytes of p written so
+// far and the error returned by the underlying writer. A zero value for t
+// means the writes will not time out.
+func (fsys *FS) SetWriteDeadline(t time.Time) error {
+	w, ok := fsys.w.(interface{ SetWriteDeadline(t time.Time) error })
+	if !ok {
+		return wrapErr("setwritedeadline", syscall.ENOTSUP)
+	}
+	if err := w.SetWriteDeadline(t); err != nil {
+		return wrapErr("setwritedeadline", err)
+	}
+	return nil
+}
+
 func (f *file) Write(p []byte) (int, error) {
 	if f.flag == syscall.O_RDONLY {
-		return 0, wrapErr("write", syscall.EBADF)
+		return 0, f.wrapErr("write", syscall.EBADF)
 	}
 	return write(f, p)
 }
 
+// SetRaw overrides the FS line mode setting (see FS.SetLineMode) for this open
+// file. In the raw mode the Read method returns the input data as received,
+// without line editing. Otherwise Read works in the line mode using the line
+// buffer of the FS, which must be allocated. Reading in the raw mode while
+// another file is in the line mode bypasses the partially entered line.
+func (f *file) SetRaw(raw bool) {
+	f.fs.rmu.Lock()
+	if raw {
+		f.raw = 1
+	} else {
+		f.raw = -1
+	}
+	f.fs.rmu.Unlock()
+}
+
+// SetEcho overrides the FS echo setting (see FS.SetEcho) for this open file.
+// It can be used, for example, to read a password without affecting other
+// users of the terminal.
+func (f *file) SetEcho(on bool) {
+	f.fs.rmu.Lock()
+	f.fs.wmu.Lock()
+	if on {
+		f.echo = 1
+	} else {
+		f.echo = -1
+	}
+	f.fs.wmu.Unlock()
+	f.fs.rmu.Unlock()
+}
+
+// SetCharMap overrides the FS character mappings (see FS.SetCharMap) for the
+// data read and written using this open file (including the echo of the
+// read data).
+func (f *file) SetCharMap(cmap CharMap) {
+	f.fs.rmu.Lock()
+	f.fs.wmu.Lock()
+	f.cmap = cmap & mapFlags
+	f.ownMap = true
+	f.fs.wmu.Unlock()
+	f.fs.rmu.Unlock()
+}
+
+// ResetMode removes the overrides set by SetRaw, SetEcho and SetCharMap so the
+// file uses the FS settings again.
+func (f *file) ResetMode() {
+	f.fs.rmu.Lock()
+	f.fs.wmu.Lock()
+	f.raw, f.echo, f.ownMap = 0, 0, false
+	f.fs.wmu.Unlock()
+	f.fs.rmu.Unlock()
+}
+
+// flags returns the FS flags modified by the file overrides. The f.fs.rmu or
+// f.fs.wmu must be locked.
+func (f *file) flags() CharMap {
+	flags := f.fs.flags
+	if f.echo > 0 {
+		flags |= echo
+	} else if f.echo < 0 {
+		flags &^= echo
+	}
+	if f.ownMap {
+		flags = flags&^mapFlags | f.cmap
+	}
+	return flags
+}
+
 func (f *file) Stat() (fs.FileInfo, error) {
-	return &fileinfo{}, nil
+	return &fileinfo{f.name}, nil
 }
 
 func (f *file) Close() (err error) {
@@ -264,7 +920,7 @@ func (f *file) Close() (err error) {
 	f.fs.rmu.Lock()
 	f.fs.wmu.Lock()
 	if f.closed == nil {
-		err = wrapErr("close", syscall.EBADF)
+		err = f.wrapErr("close", syscall.EBADF)
 	} else {
 		f.closed()
 		f.closed = nil
@@ -274,9 +930,9 @@ func (f *file) Close() (err error) {
 	return err
 }
 
-type fileinfo struct{}
+type fileinfo struct{ name string }
 
-func (fi *fileinfo) Name() string       { return "." }
+func (fi *fileinfo) Name() string       { return fi.name }
 func (fi *fileinfo) Size() int64        { return 0 }
 func (fi *fileinfo) Mode() fs.FileMode  { return fs.ModeDevice | 0666 }
 func (fi *fileinfo) ModTime() time.Time { return time.Time{} }
@@ -0,0 +1,55 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import (
+	"bytes"
+	"io"
+)
+
+// SaveHistory writes the lines remembered by the line history (see
+// SetHistoryDepth) to w, the oldest first, each terminated by '\n'. It can be
+// used with LoadHistory to keep the history across reboots, e.g. in a file on
+// a persistent file system.
+func (fsys *FS) SaveHistory(w io.Writer) error {
+	var buf bytes.Buffer
+	fsys.rmu.Lock()
+	depth := len(fsys.hist)
+	for i := fsys.hlen; i > 0; i-- {
+		buf.Write(fsys.hist[(fsys.hnext-i+depth)%depth])
+		buf.WriteByte('\n')
+	}
+	fsys.rmu.Unlock()
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return wrapErr("savehistory", err)
+	}
+	return nil
+}
+
+// LoadHistory reads the '\n' terminated lines from r and adds them to the line
+// history. The lines that contain control characters or don't fit in the line
+// buffer together with the line terminator (see SetLineMode) are skipped.
+// LoadHistory does nothing if the line history is disabled (see
+// SetHistoryDepth).
+func (fsys *FS) LoadHistory(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return wrapErr("loadhistory", err)
+	}
+	fsys.rmu.Lock()
+	line := fsys.line // preserve the edited line
+	for len(data) != 0 {
+		var s []byte
+		s, data, _ = bytes.Cut(data, []byte{'\n'})
+		if len(s) >= cap(line) || bytes.IndexFunc(s, func(r rune) bool { return r < ' ' }) >= 0 {
+			continue
+		}
+		fsys.line = s
+		addHistory(fsys)
+	}
+	fsys.line = line
+	fsys.rmu.Unlock()
+	return nil
+}
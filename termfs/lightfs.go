@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // An LightFS provides a file system that represents a terminal device. It is
@@ -48,6 +49,35 @@ func (fsys *LightFS) Name() string { return fsys.name }
 // Usage implements the rtos.FS Usage method
 func (fsys *LightFS) Usage() (int, int, int64, int64) { return -1, -1, -1, -1 }
 
+// SetReadDeadline sets the deadline for the reads from the terminal input
+// device. It's passed to the underlying io.Reader which must implement the
+// SetReadDeadline method, otherwise SetReadDeadline returns ENOTSUP. The reads
+// that exceed the deadline return the error returned by the underlying reader.
+// A zero value for t means the reads will not time out.
+func (fsys *LightFS) SetReadDeadline(t time.Time) error {
+	r, ok := fsys.r.(readDeadliner)
+	if !ok {
+		return wrapErr("setreaddeadline", syscall.ENOTSUP)
+	}
+	if err := r.SetReadDeadline(t); err != nil {
+		return wrapErr("setreaddeadline", err)
+	}
+	return nil
+}
+
+// SetWriteDeadline works like SetReadDeadline but for the writes to the
+// terminal output device.
+func (fsys *LightFS) SetWriteDeadline(t time.Time) error {
+	w, ok := fsys.w.(interface{ SetWriteDeadline(t time.Time) error })
+	if !ok {
+		return wrapErr("setwritedeadline", syscall.ENOTSUP)
+	}
+	if err := w.SetWriteDeadline(t); err != nil {
+		return wrapErr("setwritedeadline", err)
+	}
+	return nil
+}
+
 type lightFile struct {
 	fs     *LightFS
 	closed func()
@@ -80,7 +110,7 @@ func (f *lightFile) Write(p []byte) (n int, err error) {
 }
 
 func (f *lightFile) Stat() (fs.FileInfo, error) {
-	return &fileinfo{}, nil
+	return &fileinfo{"."}, nil
 }
 
 func (f *lightFile) Close() (err error) {
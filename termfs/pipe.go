@@ -0,0 +1,129 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewPipe returns a new terminal file system named name connected to an
+// in-memory host endpoint (like a pseudoterminal pair). The data written to
+// the host endpoint are the terminal input (the typed characters, including
+// control and escape sequences) and the terminal output (including the echo)
+// can be read from it. NewPipe is intended for testing the code that uses
+// termfs without any real terminal device.
+func NewPipe(name string) (*FS, *Host) {
+	h := &Host{}
+	return New(name, &h.in, &h.out), h
+}
+
+// A Host is the host side of the in-memory terminal created by NewPipe. The
+// writes never block, the reads block until data is available.
+type Host struct {
+	in  pipe // terminal input
+	out pipe // terminal output
+}
+
+// Read reads the terminal output.
+func (h *Host) Read(p []byte) (int, error) { return h.out.Read(p) }
+
+// Write writes the terminal input.
+func (h *Host) Write(p []byte) (int, error) { return h.in.Write(p) }
+
+// Close closes the terminal input. The terminal reads return io.EOF after the
+// already written data was read.
+func (h *Host) Close() error { return h.in.Close() }
+
+// SetReadDeadline sets the deadline for reading the terminal output.
+func (h *Host) SetReadDeadline(t time.Time) error { return h.out.SetReadDeadline(t) }
+
+// pipe is an unbounded in-memory buffer with blocking reads.
+type pipe struct {
+	mu       sync.Mutex
+	buf      []byte
+	closed   bool
+	deadline time.Time
+	wait     chan struct{} // closed to wake up the waiting readers
+}
+
+func (p *pipe) notify() {
+	if p.wait != nil {
+		close(p.wait)
+		p.wait = nil
+	}
+}
+
+func (p *pipe) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		p.mu.Lock()
+		if len(p.buf) != 0 {
+			n = copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !p.deadline.IsZero() {
+			d := time.Until(p.deadline)
+			if d <= 0 {
+				p.mu.Unlock()
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		if p.wait == nil {
+			p.wait = make(chan struct{})
+		}
+		wait := p.wait
+		p.mu.Unlock()
+		select {
+		case <-wait:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, os.ErrClosed
+	}
+	p.buf = append(p.buf, b...)
+	p.notify()
+	return len(b), nil
+}
+
+func (p *pipe) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.notify()
+	p.mu.Unlock()
+	return nil
+}
+
+// SetReadDeadline allows to test the FS.SetReadMin timeout.
+func (p *pipe) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.deadline = t
+	p.notify()
+	p.mu.Unlock()
+	return nil
+}
@@ -5,6 +5,7 @@
 package termfs
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"strconv"
@@ -17,29 +18,104 @@ var errLineTooLong = errors.New("line too long")
 
 func readLine(f *file, p []byte) (n int, err error) {
 	if f.fs.rpos < 0 && f.fs.flags&eof != 0 {
+		f.fs.wmu.Lock() // fsys.flags is also read by write
 		f.fs.flags &^= eof
+		f.fs.wmu.Unlock()
 		return 0, io.EOF
 	}
-	for x := 0; f.fs.rpos < 0; {
+	if f.fs.prompt != nil && !f.fs.prompted && f.fs.rpos < 0 {
+		f.fs.prompted = true
+		if _, err := write(f, []byte(f.fs.prompt())); err != nil {
+			return 0, err
+		}
+	}
+	x := min(f.fs.lx, len(f.fs.line)) // cursor position saved by non-blocking Read
+	f.fs.lx = 0
+	for f.fs.rpos < 0 {
+		if f.nonblock {
+			if ok, err := poll(f.fs, 0); err != nil {
+				return 0, err
+			} else if !ok {
+				f.fs.lx = x
+				return 0, syscall.EAGAIN // the line isn't complete
+			}
+		} else if f.fs.ltime > 0 && len(f.fs.line) != 0 {
+			if _, ok := f.fs.r.(readDeadliner); ok {
+				if ok, err := poll(f.fs, f.fs.ltime); err != nil {
+					return 0, err
+				} else if !ok {
+					if err := lineTimeout(f, x); err != nil {
+						return 0, err
+					}
+					x = len(f.fs.line)
+					continue
+				}
+			}
+		}
 		if len(f.fs.line) == cap(f.fs.line) {
+			f.fs.stats.overruns.Add(1)
 			return 0, errLineTooLong
 		}
 		buf := p[:1] // len(p) is at least 1, use it as one byte scratch buffer
-		if _, err := f.fs.r.Read(buf); err != nil {
+		if _, err := readBuffered(f.fs, buf); err != nil {
 			return 0, err
 		}
-		c := buf[0]
-		switch c {
-		case '\r':
-			if f.fs.flags&InCRLF == 0 {
-				continue // skip CR
+		c, ok := mapIn(f.flags(), buf[0])
+		if !ok {
+			f.fs.stats.dropped.Add(1)
+			continue
+		}
+		buf[0] = c
+		key := c // c or the built-in key it's configured as (see SetLineChars)
+		if sig, ok := signal(f.fs, c); ok && !isLineChar(f.fs, c) {
+			if f.fs.sig == nil && sig != SigINT {
+				f.fs.stats.dropped.Add(1)
+				continue // skip as other special characters
 			}
-			c = '\n'
-			buf[0] = c
-			fallthrough
+			if f.fs.sig != nil {
+				f.fs.sig(sig)
+			}
+			if sig == SigTSTP {
+				continue
+			}
+			f.fs.line = f.fs.line[:0]
+			if f.fs.prompt != nil {
+				// start a new line, the next Read prints the prompt
+				f.fs.prompted = false
+				if f.flags()&echo != 0 {
+					seq := [...]byte{'^', c + '@', '\n'}
+					if _, err := write(f, seq[:]); err != nil {
+						return 0, err
+					}
+				}
+			}
+			return 0, syscall.ECANCELED // discard data and return immediately
+		}
+		if f.fs.nosig && !isLineChar(f.fs, c) {
+			for _, sc := range f.fs.sigc {
+				if c == sc && c != 0 {
+					goto insert // pass the signal character as data
+				}
+			}
+		}
+		switch {
+		case c == f.fs.eofc && c != 0:
+			key = '\x04'
+		case c == '\x04':
+			key = 0 // ^D isn't the EOF character, skip it
+		case c != 0 && (c == f.fs.eol[0] || c == f.fs.eol[1]):
+			key = '\n' // additional line terminator, stored in the line
+		}
+		switch key {
+		case '\r':
+			f.fs.stats.dropped.Add(1)
+			continue // skip CR, see InCRLF
 		case '\n':
 			x = len(f.fs.line)
 			f.fs.rpos = 0
+			f.fs.prompted = false
+			f.fs.stats.lines.Add(1)
+			addHistory(f.fs)
 		case '\x7f': //  Delete
 			c = '\b'
 			buf[0] = c
@@ -49,13 +125,14 @@ func readLine(f *file, p []byte) (n int, err error) {
 				continue
 			}
 		case esc:
-			if _, err := f.fs.r.Read(buf); err != nil {
+			if _, err := readBuffered(f.fs, buf); err != nil {
 				return 0, err
 			}
 			if buf[0] != '[' {
+				f.fs.stats.dropped.Add(1)
 				continue // skip unsupported control sequence
 			}
-			if _, err := f.fs.r.Read(buf); err != nil {
+			if _, err := readBuffered(f.fs, buf); err != nil {
 				return 0, err
 			}
 			switch buf[0] {
@@ -86,7 +163,20 @@ func readLine(f *file, p []byte) (n int, err error) {
 				}
 				buf = appendIntChar(f.fs.ansi[1:3], n, 'C')
 				x = len(f.fs.line)
-			case 'A': // ANSI Cursor Up, used for a cheap one-line history
+			case 'A': // ANSI Cursor Up, previous line from the history
+				if len(f.fs.hist) != 0 {
+					if f.fs.hidx == f.fs.hlen {
+						continue // the oldest line
+					}
+					saveEdited(f.fs)
+					f.fs.hidx++
+					if err := replaceLine(f, x, histLine(f.fs)); err != nil {
+						return 0, err
+					}
+					x = len(f.fs.line)
+					continue
+				}
+				// cheap one-line history
 				if len(f.fs.line) != 0 {
 					continue
 				}
@@ -101,11 +191,23 @@ func readLine(f *file, p []byte) (n int, err error) {
 				}
 				buf = f.fs.line
 				x = len(f.fs.line)
-			case 'B': // ANSI Cursor Down, used to (reversibly) clear the line
+			case 'B': // ANSI Cursor Down, next line from the history
+				if len(f.fs.hist) != 0 {
+					if f.fs.hidx == 0 {
+						continue // the edited line
+					}
+					f.fs.hidx--
+					if err := replaceLine(f, x, histLine(f.fs)); err != nil {
+						return 0, err
+					}
+					x = len(f.fs.line)
+					continue
+				}
+				// used to (reversibly) clear the line
 				if len(f.fs.line) == 0 {
 					continue
 				}
-				if f.fs.flags&echo != 0 {
+				if f.flags()&echo != 0 {
 					if x != 0 {
 						buf = appendIntChar(f.fs.ansi[1:3], x, 'D')
 						if _, err := write(f, buf); err != nil {
@@ -116,47 +218,76 @@ func readLine(f *file, p []byte) (n int, err error) {
 				}
 				f.fs.line = f.fs.line[:0]
 				x = 0
-			//case '1': // xterm CTRL + Arrow, used to move cursor by word
-			//	buf = f.fs.ansi[3:6]
-			//	n, err := f.fs.r.Read(buf)
-			//	if err != nil {
-			//		return 0, err
-			//	}
-			//	if n != 3 || buf[0] != ';' || buf[1] != '5' {
-			//		continue
-			//	}
-			//	switch buf[2] {
-			//	case 'C': // xterm CTRL + ->
-			//		....
-			//	case 'D': // xterm CTRL + <-
-			//		....
-			//	default
-			//		continue
-			//	}
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				var err error
+				if x, buf, err = csiParams(f, x, buf[0]); err != nil {
+					return 0, err
+				}
+				if buf == nil {
+					continue
+				}
 			default:
+				f.fs.stats.dropped.Add(1)
 				continue // skip unsupported CSI sequence
 			}
-			if f.fs.flags&echo != 0 {
+			if f.flags()&echo != 0 {
 				if _, err := write(f, buf); err != nil {
 					return 0, err
 				}
 			}
 			continue
-		case '\x03': // ANSI End Of Text (^C)
-			f.fs.line = f.fs.line[:0]
-			return 0, syscall.ECANCELED // discard data and return immediately
-		case '\x04': // ANSI End Of Transmission (^D)
+		case '\x12': // ^R, reverse history search
+			if len(f.fs.hist) == 0 {
+				f.fs.stats.dropped.Add(1)
+				continue
+			}
+			var enter bool
+			var err error
+			if x, enter, err = search(f, x); err != nil {
+				return 0, err
+			}
+			if !enter {
+				continue
+			}
+			// complete the line, search leaves room for the '\n'
+			f.fs.rpos = 0
+			f.fs.prompted = false
+			f.fs.stats.lines.Add(1)
+			addHistory(f.fs)
+			f.fs.line = append(f.fs.line, '\n')
+			if f.flags()&echo != 0 {
+				if _, err := write(f, crlf[1:]); err != nil {
+					return 0, err
+				}
+			}
+			continue // rpos >= 0 ends the loop
+		case '\t':
+			if f.fs.complete == nil {
+				f.fs.stats.dropped.Add(1)
+				continue
+			}
+			var err error
+			if x, err = complete(f, x); err != nil {
+				return 0, err
+			}
+			continue
+		case '\x04': // ANSI End Of Transmission (^D) or the EOF character
 			x = len(f.fs.line)
 			f.fs.rpos = 0
+			f.fs.prompted = false
+			f.fs.wmu.Lock()
 			f.fs.flags |= eof
+			f.fs.wmu.Unlock()
 			continue // end the line without '\n', next Read will return io.EOF
 		default:
 			if c < ' ' || c >= 0xFE {
+				f.fs.stats.dropped.Add(1)
 				continue // skip other special characters
 			}
 		}
+	insert:
 		m := len(f.fs.line)
-		if f.fs.flags&echo != 0 {
+		if f.flags()&echo != 0 {
 			if c == '\b' {
 				if x == m {
 					f.fs.ansi[3] = '\b' // this sequence deletes the last
@@ -167,7 +298,7 @@ func readLine(f *file, p []byte) (n int, err error) {
 					f.fs.ansi[3] = 'P' // ANSI Delete Character
 					buf = f.fs.ansi[:4]
 				}
-			} else if x != m {
+			} else if x != m && !f.fs.ovr {
 				f.fs.ansi[3] = '@' // ANSI Insert Character
 				f.fs.ansi[4] = c
 				buf = f.fs.ansi[1:5]
@@ -185,6 +316,10 @@ func readLine(f *file, p []byte) (n int, err error) {
 				copy(f.fs.line[x:], f.fs.line[x+1:])
 			}
 			f.fs.line = f.fs.line[:m]
+		} else if x != m && f.fs.ovr {
+			// overwrite a byte
+			f.fs.line[x] = c
+			x++
 		} else {
 			// insert new byte
 			f.fs.line = f.fs.line[:m+1]
@@ -208,13 +343,433 @@ func readLine(f *file, p []byte) (n int, err error) {
 	return n, nil
 }
 
+// complete handles the Tab key using the FS completer. It returns the new
+// cursor position.
+func complete(f *file, x int) (int, error) {
+	sug := f.fs.complete(f.fs.line, x)
+	if len(sug) == 0 {
+		return x, nil
+	}
+	prefix := sug[0]
+	for _, s := range sug[1:] {
+		n := 0
+		for n < len(prefix) && n < len(s) && prefix[n] == s[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	word := f.fs.line[bytes.LastIndexByte(f.fs.line[:x], ' ')+1 : x]
+	if len(prefix) > len(word) && bytes.HasPrefix(prefix, word) {
+		return insertText(f, x, prefix[len(word):])
+	}
+	if len(sug) == 1 {
+		return x, nil
+	}
+	if f.flags()&echo == 0 {
+		return x, nil
+	}
+	// print the suggestions below the line and redraw it
+	if _, err := write(f, crlf[1:]); err != nil {
+		return x, err
+	}
+	for i, s := range sug {
+		if i != 0 {
+			if _, err := write(f, []byte("  ")); err != nil {
+				return x, err
+			}
+		}
+		if _, err := write(f, s); err != nil {
+			return x, err
+		}
+	}
+	if _, err := write(f, crlf[1:]); err != nil {
+		return x, err
+	}
+	return x, redraw(f, x)
+}
+
+// redraw prints the prompt and the edited line from the beginning of the
+// current terminal line and moves the cursor to the position x.
+func redraw(f *file, x int) error {
+	if _, err := write(f, crlf[:1]); err != nil {
+		return err
+	}
+	if f.fs.prompt != nil {
+		if _, err := write(f, []byte(f.fs.prompt())); err != nil {
+			return err
+		}
+	}
+	if _, err := write(f, f.fs.line); err != nil {
+		return err
+	}
+	f.fs.ansi[3] = 'K' // ANSI Erase in Line (to the end of line)
+	if _, err := write(f, f.fs.ansi[1:4]); err != nil {
+		return err
+	}
+	if n := len(f.fs.line) - x; n != 0 {
+		if _, err := write(f, appendIntChar(f.fs.ansi[1:3], n, 'D')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertText inserts s into the edited line at the cursor position x as far as
+// the line buffer capacity allows. It returns the new cursor position.
+func insertText(f *file, x int, s []byte) (int, error) {
+	m := len(f.fs.line)
+	if room := cap(f.fs.line) - m; len(s) > room {
+		s = s[:room]
+	}
+	if len(s) == 0 {
+		return x, nil
+	}
+	if f.flags()&echo != 0 {
+		if x != m {
+			// ANSI Insert Character
+			if _, err := write(f, appendIntChar(f.fs.ansi[1:3], len(s), '@')); err != nil {
+				return x, err
+			}
+		}
+		if _, err := write(f, s); err != nil {
+			return x, err
+		}
+	}
+	f.fs.line = f.fs.line[:m+len(s)]
+	copy(f.fs.line[x+len(s):], f.fs.line[x:m])
+	copy(f.fs.line[x:], s)
+	if m := len(f.fs.line); m != cap(f.fs.line) {
+		f.fs.line[:m+1][m] = 0 // see the one line history
+	}
+	return x + len(s), nil
+}
+
+// wordRight returns the position of the end of the word after x.
+func wordRight(line []byte, x int) int {
+	for x < len(line) && line[x] == ' ' {
+		x++
+	}
+	for x < len(line) && line[x] != ' ' {
+		x++
+	}
+	return x
+}
+
+// wordLeft returns the position of the beginning of the word before x.
+func wordLeft(line []byte, x int) int {
+	for x > 0 && line[x-1] == ' ' {
+		x--
+	}
+	for x > 0 && line[x-1] != ' ' {
+		x--
+	}
+	return x
+}
+
+// histLine returns the history line selected by fsys.hidx or the saved edited
+// line if fsys.hidx == 0.
+func histLine(fsys *FS) []byte {
+	if fsys.hidx == 0 {
+		return fsys.hsave
+	}
+	return histAt(fsys, fsys.hidx)
+}
+
+// saveEdited saves the edited line if the history navigation is about to leave
+// it, so it can be restored when the navigation returns to it.
+func saveEdited(fsys *FS) {
+	if fsys.hidx == 0 {
+		fsys.hsave = append(fsys.hsave[:0], fsys.line...)
+	}
+}
+
+// histAt returns the i-th previous line from the history (1 is the last
+// added line) or nil if i == 0.
+func histAt(fsys *FS, i int) []byte {
+	if i == 0 {
+		return nil
+	}
+	depth := len(fsys.hist)
+	return fsys.hist[(fsys.hnext-i+depth)%depth]
+}
+
+// findHist returns the index (see histAt) of the first history line that
+// contains query, starting from the i-th previous line, or 0 if not found.
+func findHist(fsys *FS, query []byte, i int) int {
+	for ; i <= fsys.hlen; i++ {
+		if bytes.Contains(histAt(fsys, i), query) {
+			return i
+		}
+	}
+	return 0
+}
+
+// search implements the reverse incremental history search (Ctrl+R). The
+// typed characters extend the query, Ctrl+R finds the next older match,
+// Ctrl+G (or the interrupt character) aborts the search. Any other key
+// accepts the found line for editing, Enter accepts it as the complete line.
+// The x is the cursor position. search returns the new cursor position and
+// reports whether the line was completed by Enter.
+func search(f *file, x int) (int, bool, error) {
+	fsys := f.fs
+	var qbuf [32]byte
+	query := qbuf[:0]
+	idx := 0 // index of the found line (see histAt)
+	for {
+		if err := drawSearch(f, query, idx); err != nil {
+			return x, false, err
+		}
+		var b [1]byte
+		if _, err := readBuffered(fsys, b[:]); err != nil {
+			return x, false, err
+		}
+		c, ok := mapIn(f.flags(), b[0])
+		switch {
+		case !ok:
+			continue
+		case c == '\x12': // ^R
+			if i := findHist(fsys, query, idx+1); i != 0 {
+				idx = i
+			}
+			continue
+		case c == '\b' || c == '\x7f':
+			if len(query) != 0 {
+				query = query[:len(query)-1]
+				idx = findHist(fsys, query, 1)
+			}
+			continue
+		case c >= ' ' && c < 0xFE && c != '\x7f':
+			query = append(query, c)
+			if i := findHist(fsys, query, max(idx, 1)); i != 0 {
+				idx = i
+			}
+			continue
+		case c == '\x07' || c == fsys.sigc[SigINT] && c != 0: // ^G, ^C
+			idx = 0 // leave the edited line unchanged
+		case c == esc:
+			// consume the whole control sequence (e.g. arrow key)
+			if _, err := readBuffered(fsys, b[:]); err != nil {
+				return x, false, err
+			}
+			for b[0] == '[' || b[0] >= '0' && b[0] <= '9' || b[0] == ';' {
+				if _, err := readBuffered(fsys, b[:]); err != nil {
+					return x, false, err
+				}
+			}
+		}
+		if idx != 0 {
+			saveEdited(fsys)
+			fsys.hidx = idx
+			s := histAt(fsys, idx)
+			fsys.line = append(fsys.line[:0], s[:min(len(s), maxRecall(fsys))]...)
+			x = len(fsys.line)
+		}
+		if f.flags()&echo != 0 {
+			if err := redraw(f, x); err != nil {
+				return x, false, err
+			}
+		}
+		return x, c == '\n', nil
+	}
+}
+
+// drawSearch prints the search prompt with the query and the found line.
+func drawSearch(f *file, query []byte, idx int) error {
+	if f.flags()&echo == 0 {
+		return nil
+	}
+	found := histAt(f.fs, idx)
+	label := "\r(reverse-i-search)`"
+	if len(query) != 0 && !bytes.Contains(found, query) {
+		label = "\r(failed reverse-i-search)`"
+	}
+	f.fs.ansi[3] = 'K' // ANSI Erase in Line (to the end of line)
+	for _, s := range [...][]byte{[]byte(label), query, []byte("': "), found, f.fs.ansi[1:4]} {
+		if _, err := write(f, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxRecall returns the maximum length of a history line recalled into the line
+// buffer. It leaves room for the line terminator.
+func maxRecall(fsys *FS) int {
+	return max(cap(fsys.line)-1, 0)
+}
+
+// isLineChar reports whether c is one of the characters set by SetLineChars.
+// They take precedence over the signal characters.
+func isLineChar(fsys *FS, c byte) bool {
+	return c != 0 && (c == fsys.eofc || c == fsys.eol[0] || c == fsys.eol[1])
+}
+
+// addHistory adds the current line to the history if it isn't empty and
+// differs from the last added one.
+func addHistory(fsys *FS) {
+	fsys.hidx = 0
+	depth := len(fsys.hist)
+	if depth == 0 || len(fsys.line) == 0 {
+		return
+	}
+	if fsys.hlen != 0 && string(fsys.hist[(fsys.hnext-1+depth)%depth]) == string(fsys.line) {
+		return
+	}
+	fsys.hist[fsys.hnext] = append(fsys.hist[fsys.hnext][:0], fsys.line...)
+	fsys.hnext = (fsys.hnext + 1) % depth
+	if fsys.hlen < depth {
+		fsys.hlen++
+	}
+}
+
+// csiParams handles the control sequences with parameters (ESC [ params
+// final) sent by the Home, End, Insert, Delete, PageUp, PageDown keys and the
+// Ctrl+Arrow keys. The c is the first parameter byte, x is the cursor
+// position. It returns the new cursor position and the sequence to echo or
+// nil if there is nothing to echo.
+func csiParams(f *file, x int, c byte) (int, []byte, error) {
+	var par [8]byte
+	n := 0
+	for c < 0x40 || c > 0x7e {
+		if n < len(par) {
+			par[n] = c
+			n++
+		}
+		var b [1]byte
+		if _, err := readBuffered(f.fs, b[:]); err != nil {
+			return x, nil, err
+		}
+		c = b[0]
+	}
+	fsys := f.fs
+	line := fsys.line
+	switch c {
+	case '~': // VT220 editing keys
+		switch string(par[:n]) {
+		case "1", "7": // Home
+			if x != 0 {
+				return 0, appendIntChar(fsys.ansi[1:3], x, 'D'), nil
+			}
+		case "4", "8": // End
+			if n := len(line) - x; n != 0 {
+				return len(line), appendIntChar(fsys.ansi[1:3], n, 'C'), nil
+			}
+		case "2": // Insert, toggles the insert/overwrite mode
+			fsys.ovr = !fsys.ovr
+		case "3": // Delete, deletes the character under the cursor
+			if x == len(line) {
+				break
+			}
+			copy(line[x:], line[x+1:])
+			line = line[:len(line)-1]
+			line[:len(line)+1][len(line)] = 0 // see one line history
+			fsys.line = line
+			fsys.ansi[3] = 'P' // ANSI Delete Character
+			return x, fsys.ansi[1:4], nil
+		case "5", "6": // PageUp, PageDown: the oldest line, the edited line
+			if len(fsys.hist) == 0 {
+				break
+			}
+			hidx := 0
+			if par[0] == '5' {
+				hidx = fsys.hlen
+			}
+			if hidx == fsys.hidx {
+				break
+			}
+			saveEdited(fsys)
+			fsys.hidx = hidx
+			if err := replaceLine(f, x, histLine(fsys)); err != nil {
+				return x, nil, err
+			}
+			return len(fsys.line), nil, nil
+		}
+	case 'C', 'D': // xterm Ctrl + Arrow, used to move cursor by word
+		if string(par[:n]) != "1;5" {
+			break
+		}
+		var m int
+		if c == 'C' {
+			m = wordRight(line, x) - x
+		} else {
+			m = x - wordLeft(line, x)
+		}
+		if m == 0 {
+			break
+		}
+		seq := appendIntChar(fsys.ansi[1:3], m, c)
+		if c == 'C' {
+			return x + m, seq, nil
+		}
+		return x - m, seq, nil
+	}
+	return x, nil, nil
+}
+
+// lineTimeout handles the partial line timeout (see SetLineTimeout). The x is
+// the current cursor position.
+func lineTimeout(f *file, x int) error {
+	if f.fs.ldiscard {
+		return replaceLine(f, x, nil)
+	}
+	f.fs.rpos = 0 // deliver the line without terminator
+	f.fs.prompted = false
+	if f.flags()&echo != 0 {
+		if _, err := write(f, crlf[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceLine replaces the content of the edited line with s and redraws it if
+// the echo is enabled. The s is truncated to leave room for the line
+// terminator in the line buffer. The x is the current cursor position. The
+// cursor is left at the end of the line.
+func replaceLine(f *file, x int, s []byte) error {
+	s = s[:min(len(s), maxRecall(f.fs))]
+	if f.fs.prompt != nil {
+		f.fs.line = append(f.fs.line[:0], s...)
+		if f.flags()&echo == 0 {
+			return nil
+		}
+		return redraw(f, len(f.fs.line))
+	}
+	if f.flags()&echo != 0 {
+		if x != 0 {
+			if _, err := write(f, appendIntChar(f.fs.ansi[1:3], x, 'D')); err != nil {
+				return err
+			}
+		}
+		if len(f.fs.line) != 0 {
+			f.fs.ansi[3] = 'K' // ANSI Erase in Line (to the end of line)
+			if _, err := write(f, f.fs.ansi[1:4]); err != nil {
+				return err
+			}
+		}
+		if _, err := write(f, s); err != nil {
+			return err
+		}
+	}
+	f.fs.line = append(f.fs.line[:0], s...)
+	return nil
+}
+
+// maxParam is the largest parameter value used in a single control sequence.
+// Some terminals limit the parameter values so larger movements are split.
+const maxParam = 999
+
+// appendIntChar appends the parameter n and the final character c of the
+// control sequence to buf which must end with the Control Sequence Introducer
+// (ESC [). If n > maxParam the sequence is repeated as many times as needed.
+// Typically buf is a slice of the FS ansi array that is big enough for a
+// single sequence so appendIntChar allocates only for large parameters.
 func appendIntChar(buf []byte, n int, c byte) []byte {
-	if n > 999 {
-		n = 999
+	for n > maxParam {
+		buf = strconv.AppendUint(buf, maxParam, 10)
+		buf = append(buf, c, esc, '[')
+		n -= maxParam
 	}
 	buf = strconv.AppendUint(buf, uint64(n), 10)
-	m := len(buf)
-	buf = buf[:m+1]
-	buf[m] = c
-	return buf
+	return append(buf, c)
 }
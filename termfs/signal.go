@@ -0,0 +1,108 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+// A Signal represents a signal generated by a special input character (see
+// SetSignalChars).
+type Signal uint8
+
+const (
+	SigINT  Signal = iota // interrupt, ^C by default
+	SigQUIT               // quit, ^\ by default
+	SigTSTP               // suspend, ^Z by default
+)
+
+var sigNames = [...]string{"interrupt", "quit", "suspend"}
+
+func (sig Signal) String() string {
+	if int(sig) < len(sigNames) {
+		return sigNames[sig]
+	}
+	return "unknown signal"
+}
+
+// SignalChars returns the characters that generate the signals.
+func (fsys *FS) SignalChars() (intr, quit, susp byte) {
+	fsys.rmu.Lock()
+	intr, quit, susp = fsys.sigc[SigINT], fsys.sigc[SigQUIT], fsys.sigc[SigTSTP]
+	fsys.rmu.Unlock()
+	return
+}
+
+// SetSignalChars sets the characters that generate the SigINT, SigQUIT and
+// SigTSTP signals. Use 0 to disable a signal.
+func (fsys *FS) SetSignalChars(intr, quit, susp byte) {
+	fsys.rmu.Lock()
+	fsys.sigc = [3]byte{intr, quit, susp}
+	fsys.rmu.Unlock()
+}
+
+// Signals reports whether the signal characters are recognized.
+func (fsys *FS) Signals() bool {
+	fsys.rmu.Lock()
+	isig := !fsys.nosig
+	fsys.rmu.Unlock()
+	return isig
+}
+
+// SetSignals enables/disables the recognition of the signal characters (the
+// termios ISIG flag). If disabled the signal characters are passed to the
+// reading goroutine as ordinary data, also in the line mode. The recognition
+// is enabled by default.
+func (fsys *FS) SetSignals(enable bool) {
+	fsys.rmu.Lock()
+	fsys.nosig = !enable
+	fsys.rmu.Unlock()
+}
+
+// SetSignalHandler sets the function called when a signal character is
+// received. The handler is called by the reading goroutine with the input
+// locked so it must not read from the FS and should return quickly (e.g. pass
+// the signal to a channel without blocking).
+//
+// In the line mode SigINT and SigQUIT discard the edited line and the pending
+// Read returns ECANCELED while SigTSTP only calls the handler. Without any
+// handler only SigINT is recognized in the line mode and the other signal
+// characters are dropped like the other control characters. In the raw mode the
+// signal characters are recognized only if the handler is set: they are removed
+// from the read data and passed to the handler. The line characters (see
+// SetLineChars) take precedence over the signal characters.
+func (fsys *FS) SetSignalHandler(handler func(sig Signal)) {
+	fsys.rmu.Lock()
+	fsys.sig = handler
+	fsys.rmu.Unlock()
+}
+
+// signal reports whether c is a signal character. The fsys.rmu must be locked.
+func signal(fsys *FS, c byte) (Signal, bool) {
+	if fsys.nosig || c == 0 {
+		return 0, false
+	}
+	for i, sc := range fsys.sigc {
+		if c == sc {
+			return Signal(i), true
+		}
+	}
+	return 0, false
+}
+
+// filterSignals removes the signal characters from p, calling the signal
+// handler for every one of them. It returns the remaining number of bytes in
+// p. The fsys.rmu must be locked.
+func filterSignals(fsys *FS, p []byte) int {
+	if fsys.sig == nil {
+		return len(p)
+	}
+	n := 0
+	for _, c := range p {
+		if sig, ok := signal(fsys, c); ok {
+			fsys.sig(sig)
+			continue
+		}
+		p[n] = c
+		n++
+	}
+	return n
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import "sync/atomic"
+
+// Stats contains the terminal I/O counters.
+type Stats struct {
+	BytesRead    uint64 // bytes returned by Read
+	BytesWritten uint64 // bytes written to the output device, including echo
+	Lines        uint64 // lines completed in the line mode
+	Dropped      uint64 // input characters ignored as unsupported or unmapped
+	Overruns     uint64 // lines rejected because the line buffer was full
+}
+
+// counters holds the FS statistics.
+type counters struct {
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	lines        atomic.Uint64
+	dropped      atomic.Uint64
+	overruns     atomic.Uint64
+}
+
+// Stats returns the current values of the terminal I/O counters. The counters
+// are updated without locking the terminal so they may be slightly
+// inconsistent with each other.
+func (fsys *FS) Stats() Stats {
+	c := &fsys.stats
+	return Stats{
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		Lines:        c.lines.Load(),
+		Dropped:      c.dropped.Load(),
+		Overruns:     c.overruns.Load(),
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectErr(t *testing.T, expect, got error) {
+	t.Helper()
+	if !errors.Is(got, expect) {
+		t.Fatalf("expected '%v' error, got '%v'", expect, got)
+	}
+}
+
+func nop() {}
+
+type termFile interface {
+	io.ReadWriter
+	SetRaw(raw bool)
+}
+
+func open(t *testing.T, fsys *FS, flag int) termFile {
+	t.Helper()
+	f, err := fsys.OpenWithFinalizer(".", flag, 0, nop)
+	checkErr(t, err)
+	return f.(termFile)
+}
+
+func checkRead(t *testing.T, r io.Reader, expect string) {
+	t.Helper()
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	checkErr(t, err)
+	if got := string(buf[:n]); got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+}
+
+// output returns the terminal output written so far.
+func output(t *testing.T, h *Host) string {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, 64)
+	for {
+		checkErr(t, h.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		n, err := h.Read(buf)
+		out = append(out, buf[:n]...)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		checkErr(t, err)
+	}
+	checkErr(t, h.SetReadDeadline(time.Time{}))
+	return string(out)
+}
+
+func TestLineEditing(t *testing.T) {
+	fsys, h := NewPipe("term")
+	fsys.SetLineMode(true, 16)
+	fsys.SetCharMap(InCRLF | OutLFCRLF)
+	f := open(t, fsys, syscall.O_RDWR)
+
+	h.Write([]byte("ac\x1b[Db\x1b[F\bd\r"))
+	checkRead(t, f, "abd\n")
+
+	fsys.SetEcho(true)
+	h.Write([]byte("xy\x1b[Dz\r"))
+	checkRead(t, f, "xzy\n")
+	if out, expect := output(t, h), "xy\x1b[D\x1b[@z\r\n"; out != expect {
+		t.Fatalf("echo: expected %q, got %q", expect, out)
+	}
+	fsys.SetEcho(false)
+
+	// partial reads of a line
+	h.Write([]byte("12345\r"))
+	buf := make([]byte, 4)
+	n, err := f.Read(buf)
+	checkErr(t, err)
+	if string(buf[:n]) != "1234" {
+		t.Fatalf("got %q", buf[:n])
+	}
+	checkRead(t, f, "5\n")
+
+	// line history
+	fsys.SetHistoryDepth(4)
+	for _, s := range []string{"one", "two", "three"} {
+		h.Write([]byte(s + "\r"))
+		checkRead(t, f, s+"\n")
+	}
+	h.Write([]byte("\x1b[A\x1b[A\r"))
+	checkRead(t, f, "two\n")
+	h.Write([]byte("\x1b[A\x1b[A\x1b[B\r"))
+	checkRead(t, f, "two\n")
+
+	// reverse search
+	h.Write([]byte("\x12on\r"))
+	checkRead(t, f, "one\n")
+	h.Write([]byte("\x12t\x12\x12\x07x\r"))
+	checkRead(t, f, "x\n")
+
+	// the edited line is restored after browsing the history
+	h.Write([]byte("par\x1b[A\x1b[A\x1b[B\x1b[Btial\r"))
+	checkRead(t, f, "partial\n")
+	h.Write([]byte("par\x1b[5~\x1b[6~tial\r"))
+	checkRead(t, f, "partial\n")
+
+	// EOF character
+	h.Write([]byte("ab\x04\x04"))
+	checkRead(t, f, "ab")
+	_, err = f.Read(buf)
+	expectErr(t, io.EOF, err)
+}
+
+func TestLoadHistory(t *testing.T) {
+	fsys, h := NewPipe("term")
+	fsys.SetLineMode(true, 8)
+	fsys.SetHistoryDepth(4)
+	checkErr(t, fsys.LoadHistory(strings.NewReader("abcdefgh\nab\x01\nabc\n")))
+	var sb strings.Builder
+	checkErr(t, fsys.SaveHistory(&sb))
+	if sb.String() != "abc\n" {
+		t.Fatalf("history: %q", sb.String())
+	}
+	f := open(t, fsys, syscall.O_RDONLY)
+	h.Write([]byte("\x1b[A\n"))
+	checkRead(t, f, "abc\n")
+}
+
+func TestRecallLongLine(t *testing.T) {
+	fsys, h := NewPipe("term")
+	fsys.SetLineMode(true, 16)
+	fsys.SetHistoryDepth(4)
+	f := open(t, fsys, syscall.O_RDONLY)
+	h.Write([]byte("abcdefgh\n"))
+	checkRead(t, f, "abcdefgh\n")
+
+	// the recalled entry is truncated to leave room for the terminator
+	fsys.SetLineMode(true, 8)
+	h.Write([]byte("\x12abc\n"))
+	checkRead(t, f, "abcdefg\n")
+	h.Write([]byte("\x1b[A\x1b[A\n"))
+	checkRead(t, f, "abcdefg\n")
+}
+
+func TestReadMin(t *testing.T) {
+	fsys, h := NewPipe("term")
+	f := open(t, fsys, syscall.O_RDONLY)
+
+	fsys.SetReadMin(4, 20*time.Millisecond)
+	go func() {
+		for _, c := range []byte("abcdef") {
+			h.Write([]byte{c})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	buf := make([]byte, 4)
+	n, err := f.Read(buf)
+	checkErr(t, err)
+	if string(buf[:n]) != "abcd" {
+		t.Fatalf("got %q", buf[:n])
+	}
+
+	// inter-byte timeout
+	n, err = f.Read(buf)
+	checkErr(t, err)
+	if string(buf[:n]) != "ef" {
+		t.Fatalf("got %q", buf[:n])
+	}
+
+	// no timeout before the first byte
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.Write([]byte("g"))
+	}()
+	checkRead(t, f, "g")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("returned before the first byte")
+	}
+
+	h.Close()
+	_, err = f.Read(buf)
+	expectErr(t, io.EOF, err)
+}
+
+func TestSignals(t *testing.T) {
+	fsys, h := NewPipe("term")
+	fsys.SetLineMode(true, 16)
+	f := open(t, fsys, syscall.O_RDWR)
+
+	// without handler only ^C is recognized
+	h.Write([]byte("ab\x03"))
+	_, err := f.Read(make([]byte, 8))
+	expectErr(t, syscall.ECANCELED, err)
+	h.Write([]byte("c\x1a\x1c\n"))
+	checkRead(t, f, "c\n")
+
+	var sigs []Signal
+	fsys.SetSignalHandler(func(sig Signal) { sigs = append(sigs, sig) })
+	h.Write([]byte("ab\x1cde\x1af\n"))
+	_, err = f.Read(make([]byte, 8))
+	expectErr(t, syscall.ECANCELED, err)
+	checkRead(t, f, "def\n")
+	if len(sigs) != 2 || sigs[0] != SigQUIT || sigs[1] != SigTSTP {
+		t.Fatalf("signals: %v", sigs)
+	}
+
+	// configurable characters
+	sigs = sigs[:0]
+	fsys.SetSignalChars('\x18', 0, 0)
+	h.Write([]byte("a\x03\x18b\n"))
+	_, err = f.Read(make([]byte, 8))
+	expectErr(t, syscall.ECANCELED, err)
+	checkRead(t, f, "b\n")
+	if len(sigs) != 1 || sigs[0] != SigINT {
+		t.Fatalf("signals: %v", sigs)
+	}
+
+	// the line characters take precedence
+	fsys.SetSignalChars('\x03', '\x1c', '\x1a')
+	fsys.SetLineChars(0, 0, '\x1a')
+	sigs = sigs[:0]
+	h.Write([]byte("ab\x1a"))
+	checkRead(t, f, "ab")
+	_, err = f.Read(make([]byte, 8))
+	expectErr(t, io.EOF, err)
+	h.Write([]byte("cd\n"))
+	checkRead(t, f, "cd\n")
+	if len(sigs) != 0 {
+		t.Fatalf("signals: %v", sigs)
+	}
+	fsys.SetLineChars(0, 0, '\x04')
+	fsys.SetSignalChars('\x18', 0, 0)
+
+	// raw mode
+	sigs = sigs[:0]
+	f.SetRaw(true)
+	h.Write([]byte("x\x18y"))
+	checkRead(t, f, "xy")
+	if len(sigs) != 1 {
+		t.Fatalf("signals: %v", sigs)
+	}
+
+	// ISIG off
+	fsys.SetSignals(false)
+	h.Write([]byte("x\x18y"))
+	checkRead(t, f, "x\x18y")
+	f.SetRaw(false)
+	h.Write([]byte("x\x18y\n"))
+	checkRead(t, f, "x\x18y\n")
+}
+
+func TestNonblock(t *testing.T) {
+	fsys, h := NewPipe("term")
+	fsys.SetLineMode(true, 16)
+	f := open(t, fsys, syscall.O_RDONLY|syscall.O_NONBLOCK)
+	buf := make([]byte, 8)
+
+	_, err := f.Read(buf)
+	expectErr(t, syscall.EAGAIN, err)
+	h.Write([]byte("ab\x1b[D"))
+	_, err = f.Read(buf)
+	expectErr(t, syscall.EAGAIN, err)
+	h.Write([]byte("c\n"))
+	checkRead(t, f, "acb\n")
+
+	f.SetRaw(true)
+	_, err = f.Read(buf)
+	expectErr(t, syscall.EAGAIN, err)
+	h.Write([]byte("xyz"))
+	checkRead(t, f, "xyz")
+
+	// the input device must support deadlines
+	_, err = New("term", strings.NewReader(""), io.Discard).OpenWithFinalizer(".", syscall.O_RDONLY|syscall.O_NONBLOCK, 0, nop)
+	expectErr(t, syscall.EINVAL, err)
+}
+
+func TestNonblockPoller(t *testing.T) {
+	// os.Pipe fails the reads with a past deadline even if data is available
+	r, w, err := os.Pipe()
+	checkErr(t, err)
+	defer r.Close()
+	defer w.Close()
+	fsys := New("term", r, io.Discard)
+	f := open(t, fsys, syscall.O_RDONLY|syscall.O_NONBLOCK)
+	buf := make([]byte, 8)
+
+	_, err = f.Read(buf)
+	expectErr(t, syscall.EAGAIN, err)
+	w.Write([]byte("abc"))
+	time.Sleep(10 * time.Millisecond)
+	checkRead(t, f, "abc")
+
+	fsys.SetLineMode(true, 16)
+	w.Write([]byte("de\n"))
+	time.Sleep(10 * time.Millisecond)
+	checkRead(t, f, "de\n")
+}
+
+func TestWindowSize(t *testing.T) {
+	fsys, h := NewPipe("term")
+	h.Write([]byte("typed\x1b[A\x1b[24;132R"))
+	rows, cols, err := fsys.WindowSize()
+	checkErr(t, err)
+	if rows != 24 || cols != 132 {
+		t.Fatalf("got %dx%d", rows, cols)
+	}
+	if out, expect := output(t, h), "\x1b7\x1b[999;999H\x1b[6n\x1b8"; out != expect {
+		t.Fatalf("expected %q, got %q", expect, out)
+	}
+
+	h.Write([]byte("\x1b[;80R"))
+	_, _, err = fsys.WindowSize()
+	expectErr(t, syscall.EIO, err)
+}
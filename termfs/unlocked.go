@@ -0,0 +1,55 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import "io"
+
+// An UnlockedWriter writes directly to the terminal output device, bypassing
+// the FS locks. It's intended for panic handlers and fault reporters that
+// can't rely on the normal write path because it may be locked by the
+// interrupted code. The output of an UnlockedWriter can interleave with the
+// output of other writers. It performs only the OutLFCRLF mapping (if enabled)
+// and doesn't allocate. The UnlockedWriter itself is a pointer sized value so
+// it can be converted to io.Writer without allocation.
+type UnlockedWriter struct {
+	fsys *FS
+}
+
+// UnlockedWriter returns the UnlockedWriter for fsys.
+func (fsys *FS) UnlockedWriter() UnlockedWriter {
+	return UnlockedWriter{fsys}
+}
+
+// Write writes p to the terminal output device. It doesn't lock or allocate.
+// Whether it can be called from an interrupt handler depends on the Write
+// method of the underlying io.Writer.
+func (w UnlockedWriter) Write(p []byte) (n int, err error) {
+	fsys := w.fsys
+	if fsys.flags&OutLFCRLF == 0 {
+		return fsys.w.Write(p)
+	}
+	for n < len(p) {
+		m := n
+		for m < len(p) && p[m] != '\n' {
+			m++
+		}
+		if m != n {
+			var k int
+			k, err = fsys.w.Write(p[n:m])
+			n += k
+			if err == nil && n != m {
+				err = io.ErrShortWrite
+			}
+			if err != nil || n == len(p) {
+				break
+			}
+		}
+		if _, err = fsys.w.Write(crlf[:]); err != nil {
+			break
+		}
+		n++
+	}
+	return n, err
+}
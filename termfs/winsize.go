@@ -0,0 +1,83 @@
+// Copyright 2020 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package termfs
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// windowSizeTimeout is the time to wait for the terminal response if the
+// input device supports read deadlines.
+const windowSizeTimeout = time.Second
+
+// WindowSize queries the terminal about its size. It saves the cursor
+// position, moves the cursor to the bottom right corner, asks for its position
+// using the ANSI Device Status Report and restores the cursor position. The
+// terminal input and output are locked during the query. The input characters
+// received before the response are discarded. If the input device implements
+// the SetReadDeadline method WindowSize waits at most one second for the
+// response, otherwise it blocks until the response is received.
+func (fsys *FS) WindowSize() (rows, cols int, err error) {
+	fsys.rmu.Lock()
+	fsys.wmu.Lock()
+	dr, _ := fsys.r.(readDeadliner)
+	if dr != nil {
+		if err = dr.SetReadDeadline(time.Now().Add(windowSizeTimeout)); err != nil {
+			goto end
+		}
+	}
+	// save cursor, move to 999;999, query position
+	if _, err = fsys.output([]byte("\x1b7\x1b[999;999H\x1b[6n")); err != nil {
+		goto end
+	}
+	rows, cols, err = readCPR(fsys)
+	// restore cursor
+	if _, werr := fsys.output([]byte("\x1b8")); err == nil {
+		err = werr
+	}
+end:
+	if dr != nil {
+		dr.SetReadDeadline(time.Time{})
+	}
+	fsys.wmu.Unlock()
+	fsys.rmu.Unlock()
+	if err != nil {
+		err = &fs.PathError{Op: "windowsize", Path: ".", Err: err}
+	}
+	return
+}
+
+// readCPR reads the ANSI Cursor Position Report: ESC [ rows ; cols R.
+func readCPR(fsys *FS) (rows, cols int, err error) {
+	var buf [1]byte
+	state := 0
+	for {
+		if _, err = readBuffered(fsys, buf[:]); err != nil {
+			return 0, 0, err
+		}
+		c := buf[0]
+		switch {
+		case c == esc:
+			state, rows, cols = 1, 0, 0
+		case state == 1 && c == '[':
+			state = 2
+		case state == 2 && c >= '0' && c <= '9':
+			rows = rows*10 + int(c-'0')
+		case state == 2 && c == ';':
+			state = 3
+		case state == 3 && c >= '0' && c <= '9':
+			cols = cols*10 + int(c-'0')
+		case state == 3 && c == 'R':
+			if rows == 0 || cols == 0 {
+				return 0, 0, syscall.EIO
+			}
+			return rows, cols, nil
+		default:
+			state = 0 // skip other input
+		}
+	}
+}